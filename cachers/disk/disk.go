@@ -3,14 +3,17 @@ package disk
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
 )
 
 type indexEntry struct {
@@ -22,86 +25,251 @@ type indexEntry struct {
 
 type DiskCache struct {
 	dir     string
-	verbose bool
+	maxSize int64
+	durable bool
+	pin     bool
+	usage   usage
+}
+
+// Options configures a DiskCache.
+type Options struct {
+	// MaxSize is how many bytes of entries the cache may hold before the
+	// least recently used ones are evicted, in the background, until ctx
+	// is done. Zero lets it grow indefinitely.
+	MaxSize int64
+
+	// TrimAge is how long entries may go unused before they are trimmed,
+	// in the background, on NewCache; TrimInterval is how often at most.
+	// Zero TrimAge disables trimming.
+	TrimAge      time.Duration
+	TrimInterval time.Duration
+
+	// Durable syncs every file written, and the directory it is in, before
+	// it is used, so that a power loss can't leave an action whose output
+	// was never written out. It makes puts slower.
+	Durable bool
+
+	// PinOutputs keeps the outputs served or put from being evicted or
+	// trimmed until the process exits, as cmd/go may open their DiskPath
+	// until then. Servers, which send outputs rather than their paths,
+	// leave it off so that what they hold stays under the max size.
+	PinOutputs bool
 }
 
-func NewCache(ctx context.Context, dir string, verbose bool) *DiskCache {
+func NewCache(ctx context.Context, dir string, opts Options) (*DiskCache, error) {
 	if dir == "" {
 		d, err := os.UserCacheDir()
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("no default cache dir, set one: %w", err)
 		}
 		d = filepath.Join(d, "gocacheprog")
 		dir = d
 	}
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Fatal(err)
+	for i := range 256 {
+		if err := os.MkdirAll(filepath.Join(dir, fmt.Sprintf("%02x", i)), 0755); err != nil {
+			return nil, err
+		}
 	}
-	return &DiskCache{
+	dc := &DiskCache{
 		dir:     dir,
-		verbose: verbose,
+		maxSize: opts.MaxSize,
+		durable: opts.Durable,
+		pin:     opts.PinOutputs,
+		usage: usage{
+			served: map[string]struct{}{},
+			open:   map[string]int{},
+			wake:   make(chan struct{}, 1),
+		},
+	}
+	go dc.gc(ctx, opts.TrimAge, opts.TrimInterval)
+	return dc, nil
+}
+
+// gc sweeps the cache, trims it if trimAge is set, then keeps it under the
+// max size until ctx is done. They run one after the other so that they
+// don't contend for the gc lock.
+func (dc *DiskCache) gc(ctx context.Context, trimAge, trimInterval time.Duration) {
+	dc.sweep(ctx)
+	if trimAge > 0 && ctx.Err() == nil {
+		dc.maybeTrim(ctx, trimAge, trimInterval)
+	}
+	if dc.maxSize > 0 {
+		dc.evictLoop(ctx)
 	}
 }
 
-func (dc *DiskCache) Get(_ context.Context, actionID string) (string, string, int64, io.ReadCloser, error) {
-	actionFile := filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))
-	ij, err := os.ReadFile(actionFile)
+// Dir returns the directory the cache lives in.
+func (dc *DiskCache) Dir() string {
+	return dc.dir
+}
+
+// Entries are kept in subdirectories named after the first two hex digits of
+// their ID, like in cmd/go's cache. Caches made before had them all in dir,
+// and are read from as well until migrated.
+func (dc *DiskCache) shardDir(id string) string {
+	if len(id) < 2 {
+		return dc.dir
+	}
+	return filepath.Join(dc.dir, id[:2])
+}
+
+func (dc *DiskCache) actionFile(actionID string) string {
+	return filepath.Join(dc.shardDir(actionID), fmt.Sprintf("a-%s", actionID))
+}
+
+func (dc *DiskCache) outputFile(outputID string) string {
+	return filepath.Join(dc.shardDir(outputID), fmt.Sprintf("o-%s", outputID))
+}
+
+func (dc *DiskCache) flatActionFile(actionID string) string {
+	return filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))
+}
+
+func (dc *DiskCache) flatOutputFile(outputID string) string {
+	return filepath.Join(dc.dir, fmt.Sprintf("o-%s", outputID))
+}
+
+// OutputFile returns the file the output outputID is kept in, in whichever
+// layout it is.
+func (dc *DiskCache) OutputFile(outputID string) string {
+	file := dc.outputFile(outputID)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if _, err := os.Stat(dc.flatOutputFile(outputID)); err == nil {
+			return dc.flatOutputFile(outputID)
+		}
+	}
+	return file
+}
+
+func (dc *DiskCache) GetAction(_ context.Context, actionID string) (*cachers.Action, error) {
+	file := dc.actionFile(actionID)
+	ie, err := readIndexEntry(file)
+	if errors.Is(err, cachers.ErrNotFound) {
+		file = dc.flatActionFile(actionID)
+		ie, err = readIndexEntry(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// An output missing or cut short leaves the action a miss until the
+	// next sweep removes it.
+	output := dc.OutputFile(ie.OutputID)
+	fi, err := os.Stat(output)
+	if os.IsNotExist(err) || err == nil && fi.Size() != ie.Size {
+		return nil, cachers.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dc.serve(ie.OutputID)
+	if time.Since(fi.ModTime()) >= touchInterval {
+		touch(output, file)
+	}
+
+	return &cachers.Action{
+		ActionID: actionID,
+		OutputID: ie.OutputID,
+		Size:     ie.Size,
+		Time:     time.Unix(0, ie.TimeNanos),
+		DiskPath: output,
+	}, nil
+}
+
+func readIndexEntry(file string) (*indexEntry, error) {
+	ij, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, cachers.ErrNotFound
+	}
 	if err != nil {
-		return "", "", 0, nil, err
+		return nil, err
 	}
 
 	var ie indexEntry
 	if err := json.Unmarshal(ij, &ie); err != nil {
-		log.Printf("Warning: JSON error for action %q: %v", actionID, err)
-		return "", "", 0, nil, err
+		return nil, fmt.Errorf("%w: %v", cachers.ErrCorrupt, err)
 	}
 
 	if _, err := hex.DecodeString(ie.OutputID); err != nil {
 		// Protect against malicious non-hex OutputID on disk
-		return "", "", 0, nil, err
+		return nil, fmt.Errorf("%w: invalid OutputID %q", cachers.ErrCorrupt, ie.OutputID)
 	}
+	return &ie, nil
+}
 
-	return ie.OutputID, filepath.Join(dc.dir, fmt.Sprintf("o-%v", ie.OutputID)), ie.Size, io.NopCloser(bytes.NewReader(ij)), nil
+// GetOutput keeps the output from being evicted until it is closed.
+func (dc *DiskCache) GetOutput(_ context.Context, a *cachers.Action) (io.ReadCloser, error) {
+	f, err := os.Open(dc.OutputFile(a.OutputID))
+	if os.IsNotExist(err) {
+		return nil, cachers.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dc.openOutput(f, a.OutputID), nil
 }
 
-func (dc *DiskCache) Put(_ context.Context, actionID, objectID string, size int64, body io.Reader) (string, error) {
-	file := filepath.Join(dc.dir, fmt.Sprintf("o-%s", objectID))
+func (dc *DiskCache) Put(_ context.Context, actionID, objectID string, size int64, body io.Reader) (*cachers.Action, error) {
+	file := dc.outputFile(objectID)
 
-	if size == 0 {
-		zf, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
-		if err != nil {
-			return "", err
-		}
-		zf.Close()
-	} else {
-		wrote, err := writeAtomic(file, body)
-		if err != nil {
-			return "", err
-		}
-		if wrote != size {
-			return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
-		}
+	// An output already in place is kept rather than replaced: cmd/go may
+	// be reading it from a DiskPath it was given. It is touched so that it
+	// isn't evicted before the new action. Whatever is left of the body is
+	// up to the caller.
+	if fi, err := os.Stat(file); err == nil && fi.Size() == size {
+		touch(file)
+	} else if err := dc.writeOutput(file, objectID, size, body); err != nil {
+		return nil, err
 	}
 
+	now := time.Now()
 	ij, err := json.Marshal(indexEntry{
 		Version:   1,
 		OutputID:  objectID,
 		Size:      size,
-		TimeNanos: time.Now().UnixNano(),
+		TimeNanos: now.UnixNano(),
 	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if _, err := dc.writeAtomic(dc.actionFile(actionID), bytes.NewReader(ij)); err != nil {
+		return nil, err
 	}
+	dc.serve(objectID)
+	dc.added(size + int64(len(ij)))
+
+	return &cachers.Action{
+		ActionID: actionID,
+		OutputID: objectID,
+		Size:     size,
+		Time:     now,
+		DiskPath: file,
+	}, nil
+}
 
-	actionFile := filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))
-	if _, err := writeAtomic(actionFile, bytes.NewReader(ij)); err != nil {
-		return "", err
+func (dc *DiskCache) Stat(_ context.Context, outputID string) (int64, error) {
+	fi, err := os.Stat(dc.OutputFile(outputID))
+	if os.IsNotExist(err) {
+		return 0, cachers.ErrNotFound
 	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
 
-	return file, nil
+func (dc *DiskCache) Delete(_ context.Context, actionID string) error {
+	for _, file := range []string{dc.actionFile(actionID), dc.flatActionFile(actionID)} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
-func writeTempFile(dest string, r io.Reader) (string, int64, error) {
+func (dc *DiskCache) writeTempFile(dest string, r io.Reader) (_ string, size int64, err error) {
 	tf, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*")
 	if err != nil {
 		return "", 0, err
@@ -109,34 +277,81 @@ func writeTempFile(dest string, r io.Reader) (string, int64, error) {
 
 	fileName := tf.Name()
 	defer func() {
-		tf.Close()
+		if cerr := tf.Close(); err == nil {
+			err = cerr
+		}
 		if err != nil {
 			os.Remove(fileName)
 		}
 	}()
 
-	size, err := io.Copy(tf, r)
+	size, err = io.Copy(tf, r)
 	if err != nil {
 		return "", 0, err
 	}
+	if dc.durable {
+		if err = tf.Sync(); err != nil {
+			return "", 0, err
+		}
+	}
 	return fileName, size, nil
 }
 
-func writeAtomic(dest string, r io.Reader) (int64, error) {
-	tempFile, size, err := writeTempFile(dest, r)
+// writeOutput writes the output outputID, size bytes read from r, to dest.
+// It is only renamed into place once it turned out whole and hashing to
+// outputID, so that a body cut short can't replace a good output.
+func (dc *DiskCache) writeOutput(dest, outputID string, size int64, r io.Reader) error {
+	if size == 0 {
+		zf, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		zf.Close()
+		if dc.durable {
+			return syncDir(filepath.Dir(dest))
+		}
+		return nil
+	}
+
+	h := sha256.New()
+	tempFile, wrote, err := dc.writeTempFile(dest, io.TeeReader(r, h))
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	defer func() {
-		if err != nil {
-			os.Remove(tempFile)
-		}
-	}()
+	switch {
+	case wrote != size:
+		err = fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+	case hex.EncodeToString(h.Sum(nil)) != outputID:
+		err = fmt.Errorf("%w: output doesn't hash to its ID", cachers.ErrCorrupt)
+	default:
+		err = dc.commit(tempFile, dest)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+	}
+	return err
+}
 
-	if err = os.Rename(tempFile, dest); err != nil {
+func (dc *DiskCache) writeAtomic(dest string, r io.Reader) (int64, error) {
+	tempFile, size, err := dc.writeTempFile(dest, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := dc.commit(tempFile, dest); err != nil {
+		os.Remove(tempFile)
 		return 0, err
 	}
-
 	return size, nil
 }
+
+// commit renames tempFile to dest.
+func (dc *DiskCache) commit(tempFile, dest string) error {
+	if err := os.Rename(tempFile, dest); err != nil {
+		return err
+	}
+	if dc.durable {
+		return syncDir(filepath.Dir(dest))
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package disk
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// touchInterval is how stale the access time of an entry may get before
+	// a hit refreshes it. Like cmd/go's own cache, this saves a write on
+	// most hits.
+	touchInterval = time.Hour
+
+	// evictRetry is how long eviction waits to try again while another
+	// process holds the gc lock and the cache is over the max size.
+	evictRetry = 10 * time.Second
+)
+
+// usage tracks what the cache holds and which outputs are in use, so that
+// eviction can keep it under the max size without pulling outputs from under
+// a build.
+type usage struct {
+	mu     sync.Mutex
+	size   int64               // of the entries, as last counted plus puts since
+	served map[string]struct{} // outputIDs served or put, in use until exit
+	pins   *os.File            // lists served for other processes, see pinsDir
+	open   map[string]int      // outputID -> readers open from GetOutput
+	wake   chan struct{}
+}
+
+// Each process serving from the cache lists the outputs it served, whose
+// DiskPath cmd/go may open until it exits, in a file of its own in pinsDir.
+// It holds a lock on the file while it runs, so that the lists of processes
+// gone can be told apart and removed.
+const pinsDir = "pins"
+
+// serve pins outputID for as long as the process runs, if PinOutputs.
+func (dc *DiskCache) serve(outputID string) {
+	if !dc.pin {
+		return
+	}
+
+	dc.usage.mu.Lock()
+	defer dc.usage.mu.Unlock()
+
+	if _, ok := dc.usage.served[outputID]; ok {
+		return
+	}
+	dc.usage.served[outputID] = struct{}{}
+
+	if dc.usage.pins == nil {
+		f, err := dc.createPins()
+		if err != nil {
+			log.Printf("pinning outputs for other processes: %v", err)
+			return
+		}
+		dc.usage.pins = f
+	}
+	fmt.Fprintln(dc.usage.pins, outputID)
+}
+
+// createPins creates the pins file of this process, locked before it is
+// renamed into place so that no other process takes it for one left behind.
+func (dc *DiskCache) createPins() (*os.File, error) {
+	dir := filepath.Join(dc.dir, pinsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "pins-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := lockFile(f); !ok || err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, cmp.Or(err, errors.New("pins file locked"))
+	}
+	if err := os.Rename(f.Name(), strings.TrimSuffix(f.Name(), ".tmp")); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// pinned returns the outputs other processes running have served, and
+// removes the pins files of those gone.
+func (dc *DiskCache) pinned() map[string]bool {
+	dir := filepath.Join(dc.dir, pinsDir)
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	pinned := map[string]bool{}
+	for _, de := range dirents {
+		path := filepath.Join(dir, de.Name())
+		if strings.HasSuffix(de.Name(), ".tmp") {
+			if fi, err := de.Info(); err == nil && time.Since(fi.ModTime()) > staleAge {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		if ok, _ := lockFile(f); ok {
+			os.Remove(path)
+			f.Close()
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			pinned[sc.Text()] = true
+		}
+		f.Close()
+	}
+	return pinned
+}
+
+func (dc *DiskCache) inUse(outputID string) bool {
+	dc.usage.mu.Lock()
+	defer dc.usage.mu.Unlock()
+
+	_, served := dc.usage.served[outputID]
+	return served || dc.usage.open[outputID] > 0
+}
+
+// added records size more bytes in the cache, and wakes eviction up if that
+// is over the max.
+func (dc *DiskCache) added(size int64) {
+	if dc.maxSize <= 0 {
+		return
+	}
+
+	dc.usage.mu.Lock()
+	dc.usage.size += size
+	over := dc.usage.size > dc.maxSize
+	dc.usage.mu.Unlock()
+
+	if over {
+		select {
+		case dc.usage.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// touch refreshes the access time of the files of a hit.
+func touch(files ...string) {
+	now := time.Now()
+	for _, file := range files {
+		os.Chtimes(file, now, now)
+	}
+}
+
+// openOutput is an output file, in use until closed.
+type openOutput struct {
+	*os.File
+	dc       *DiskCache
+	outputID string
+	once     sync.Once
+}
+
+func (dc *DiskCache) openOutput(f *os.File, outputID string) io.ReadCloser {
+	dc.usage.mu.Lock()
+	dc.usage.open[outputID]++
+	dc.usage.mu.Unlock()
+	return &openOutput{File: f, dc: dc, outputID: outputID}
+}
+
+func (o *openOutput) Close() error {
+	o.once.Do(func() {
+		o.dc.usage.mu.Lock()
+		if o.dc.usage.open[o.outputID]--; o.dc.usage.open[o.outputID] <= 0 {
+			delete(o.dc.usage.open, o.outputID)
+		}
+		o.dc.usage.mu.Unlock()
+	})
+	return o.File.Close()
+}
+
+// evictLoop keeps the cache under the max size until ctx is done. While
+// another process sharing the cache holds the gc lock, it only counts what
+// the cache holds, and tries again later if that is over the max.
+func (dc *DiskCache) evictLoop(ctx context.Context) {
+	for {
+		var retry <-chan time.Time
+		lf, err := dc.gcLock(ctx, false)
+		switch {
+		case lf != nil:
+			dc.evict()
+			lf.Close()
+		case err != nil:
+			dc.evict()
+		default:
+			if dc.count() > dc.maxSize {
+				retry = time.After(evictRetry)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-dc.usage.wake:
+		case <-retry:
+		}
+	}
+}
+
+// count records how many bytes the cache holds, and returns it.
+func (dc *DiskCache) count() int64 {
+	_, _, total, err := dc.scan()
+	if err != nil {
+		return 0
+	}
+
+	dc.usage.mu.Lock()
+	dc.usage.size = total
+	dc.usage.mu.Unlock()
+	return total
+}
+
+type entryFile struct {
+	path  string
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+// scan lists the entry files in the cache, in both layouts, and how many
+// bytes they hold.
+func (dc *DiskCache) scan() (outputs, actions []entryFile, total int64, err error) {
+	outputs, actions, total, err = scanDir(dc.dir)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for i := range 256 {
+		o, a, n, err := scanDir(filepath.Join(dc.dir, fmt.Sprintf("%02x", i)))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, 0, err
+		}
+		outputs, actions, total = append(outputs, o...), append(actions, a...), total+n
+	}
+	return outputs, actions, total, nil
+}
+
+// scanDir lists the entry files directly in dir.
+func scanDir(dir string) (outputs, actions []entryFile, total int64, err error) {
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	for _, de := range dirents {
+		name := de.Name()
+		// Skip temp files, named after their destination plus a suffix.
+		if !de.Type().IsRegular() || strings.Contains(name, ".") {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		f := entryFile{path: filepath.Join(dir, name), name: name, size: fi.Size(), mtime: fi.ModTime()}
+		switch {
+		case strings.HasPrefix(name, "o-"):
+			outputs = append(outputs, f)
+		case strings.HasPrefix(name, "a-"):
+			actions = append(actions, f)
+		default:
+			continue
+		}
+		total += f.size
+	}
+	return outputs, actions, total, nil
+}
+
+// remove removes the entry file f, unless it is an output in use, here or
+// by another process, or it was put or hit since it was scanned.
+func (dc *DiskCache) remove(f entryFile, pinned map[string]bool) bool {
+	if outputID, ok := strings.CutPrefix(f.name, "o-"); ok && (dc.inUse(outputID) || pinned[outputID]) {
+		return false
+	}
+	if fi, err := os.Stat(f.path); err != nil || !fi.ModTime().Equal(f.mtime) {
+		return false
+	}
+	return os.Remove(f.path) == nil
+}
+
+// evict removes the least recently used outputs until the cache is down to
+// 90% of the max size, skipping the outputs in use, then the actions of the
+// outputs it removed.
+func (dc *DiskCache) evict() {
+	outputs, actions, total, err := dc.scan()
+	if err != nil {
+		return
+	}
+
+	if total > dc.maxSize {
+		slices.SortFunc(outputs, func(a, b entryFile) int { return a.mtime.Compare(b.mtime) })
+
+		// Actions are touched along with their outputs, so only those no
+		// newer than the last output removed can be left without one.
+		var cutoff time.Time
+		target := dc.maxSize / 10 * 9
+		pinned := dc.pinned()
+		for _, f := range outputs {
+			if total <= target {
+				break
+			}
+			if dc.remove(f, pinned) {
+				total -= f.size
+				cutoff = f.mtime
+			}
+		}
+
+		for _, f := range actions {
+			if f.mtime.After(cutoff) {
+				continue
+			}
+			ie, err := readIndexEntry(f.path)
+			if err != nil {
+				continue
+			}
+			if _, err := os.Stat(dc.OutputFile(ie.OutputID)); os.IsNotExist(err) && os.Remove(f.path) == nil {
+				total -= f.size
+			}
+		}
+	}
+
+	dc.usage.mu.Lock()
+	dc.usage.size = total
+	dc.usage.mu.Unlock()
+}
@@ -0,0 +1,84 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Several processes can share a cache dir, such as the go commands of one
+// CI job run in parallel. They coordinate through file locks: an action
+// being fetched is locked exclusively so the others wait for it rather than
+// fetch it too, the outputs a process has served are listed in a pins file
+// it holds locked so the others don't evict them, and eviction and trimming
+// take the gc lock so that one process at a time does them.
+
+// TryLock takes an exclusive lock on f if no other process holds one, and
+// reports whether it did. The lock is released when f is closed.
+func TryLock(f *os.File) (bool, error) {
+	return lockFile(f)
+}
+
+// lockWait takes an exclusive lock on f, polling until it gets it or ctx is
+// done.
+func lockWait(ctx context.Context, f *os.File) error {
+	wait := 5 * time.Millisecond
+	for {
+		ok, err := lockFile(f)
+		if ok || err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(2*wait, 100*time.Millisecond)
+	}
+}
+
+// LockAction waits until no other process is fetching actionID, then holds
+// it until unlock is called. It implements cachers.Locker.
+func (dc *DiskCache) LockAction(ctx context.Context, actionID string) (unlock func(), err error) {
+	path := filepath.Join(dc.shardDir(actionID), fmt.Sprintf("l-%s", actionID))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockWait(ctx, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		// A process that opened the file before it is removed may lock it
+		// alongside the next one to create it; both then fetch the action,
+		// which is only wasted work.
+		os.Remove(path)
+		f.Close()
+	}, nil
+}
+
+// gcLock takes the lock held while evicting or trimming, waiting for it if
+// wait is set. It returns nil if another process holds it.
+func (dc *DiskCache) gcLock(ctx context.Context, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dc.dir, "gc.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if wait {
+		err = lockWait(ctx, f)
+	} else {
+		var ok bool
+		if ok, err = lockFile(f); err == nil && !ok {
+			f.Close()
+			return nil, nil
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,46 @@
+package disk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Migrate moves the entries of the flat layout into their subdirectories,
+// and returns how many it moved. The cache stays in use meanwhile: entries
+// are read from either layout, and outputs are moved before the actions
+// pointing to them. It waits for any other process sharing the cache to be
+// done evicting or trimming it, and leaves the outputs other processes have
+// in use, which may have been handed out by their flat path, to a later run.
+func (dc *DiskCache) Migrate(ctx context.Context) (int, error) {
+	lf, err := dc.gcLock(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	defer lf.Close()
+
+	outputs, actions, _, err := scanDir(dc.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	pinned := dc.pinned()
+	var moved int
+	for _, f := range append(outputs, actions...) {
+		if outputID, ok := strings.CutPrefix(f.name, "o-"); ok && (dc.inUse(outputID) || pinned[outputID]) {
+			continue
+		}
+		dest := filepath.Join(dc.shardDir(f.name[len("a-"):]), f.name)
+		// An entry already in its subdirectory was put since, and wins.
+		if _, err := os.Stat(dest); err == nil {
+			os.Remove(f.path)
+			continue
+		}
+		if err := os.Rename(f.path, dest); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,122 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
+)
+
+const (
+	// staleAge is how old a temp or lock file has to be to be taken as left
+	// behind by a killed process, rather than still in use.
+	staleAge = time.Hour
+
+	// sweepInterval is how often at most actions are checked for their
+	// outputs, across the processes sharing the cache: it reads every
+	// action file.
+	sweepInterval = 24 * time.Hour
+)
+
+// sweepFile records when actions were last checked, as Unix seconds.
+const sweepFile = "sweep.txt"
+
+// sweep removes what writes cut short leave behind: stale temp and lock
+// files on every start, and once per sweepInterval, actions whose output is
+// missing or of the wrong size, as a power loss can leave them unless
+// Durable. Actions are left alone while a process sharing the cache is
+// evicting or trimming it.
+func (dc *DiskCache) sweep(ctx context.Context) {
+	var checkActions bool
+	if time.Since(dc.lastRun(sweepFile)) >= sweepInterval {
+		lf, err := dc.gcLock(ctx, false)
+		if err != nil {
+			log.Printf("sweep: %v", err)
+		}
+		if lf != nil {
+			defer lf.Close()
+			// Another process may have checked them while we took the lock.
+			checkActions = time.Since(dc.lastRun(sweepFile)) >= sweepInterval
+		}
+	}
+
+	// Actions are written after their outputs, so the output of an action
+	// older than the sweep is listed below unless it really is missing.
+	start := time.Now()
+
+	sizes := map[string]int64{} // outputID -> size
+	var actions []string
+	dirs := []string{dc.dir}
+	for i := range 256 {
+		dirs = append(dirs, filepath.Join(dc.dir, fmt.Sprintf("%02x", i)))
+	}
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			return
+		}
+		dirents, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, de := range dirents {
+			name := de.Name()
+			if !de.Type().IsRegular() || len(name) < 2 || !strings.Contains("aol", name[:1]) || name[1] != '-' {
+				continue
+			}
+			stale := strings.Contains(name, ".") || name[0] == 'l'
+			if !stale && !checkActions {
+				continue
+			}
+			fi, err := de.Info()
+			if err != nil {
+				continue
+			}
+			path := filepath.Join(dir, name)
+
+			switch {
+			case stale:
+				if start.Sub(fi.ModTime()) > staleAge {
+					os.Remove(path)
+				}
+			case name[0] == 'o':
+				if _, ok := sizes[name[2:]]; !ok || dir != dc.dir {
+					sizes[name[2:]] = fi.Size()
+				}
+			case fi.ModTime().Before(start):
+				actions = append(actions, path)
+			}
+		}
+	}
+	if !checkActions {
+		return
+	}
+
+	var removed int
+	for _, path := range actions {
+		ie, err := readIndexEntry(path)
+		switch {
+		case errors.Is(err, cachers.ErrCorrupt):
+		case err != nil:
+			continue
+		default:
+			if size, ok := sizes[ie.OutputID]; ok && size == ie.Size {
+				continue
+			}
+		}
+		if os.Remove(path) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("sweep: removed %d broken actions", removed)
+	}
+	if err := dc.recordRun(sweepFile); err != nil {
+		log.Printf("sweep: %v", err)
+	}
+}
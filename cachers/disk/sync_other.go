@@ -0,0 +1,9 @@
+//go:build !unix
+
+package disk
+
+// Directories can't be synced elsewhere; renames are as durable as the
+// filesystem makes them.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package disk
+
+import "os"
+
+// syncDir makes the entries just created in dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,98 @@
+package disk
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTrimAge and DefaultTrimInterval are what cmd/go trims its own
+	// cache by.
+	DefaultTrimAge      = 5 * 24 * time.Hour
+	DefaultTrimInterval = 24 * time.Hour
+)
+
+// trimFile records when the cache was last trimmed, as Unix seconds, so
+// that the processes sharing it trim it at most once per interval.
+const trimFile = "trim.txt"
+
+// maybeTrim trims the cache of the entries unused for maxAge, unless it was
+// trimmed less than interval ago or another process is at it.
+func (dc *DiskCache) maybeTrim(ctx context.Context, maxAge, interval time.Duration) {
+	lf, err := dc.gcLock(ctx, false)
+	if lf == nil {
+		if err != nil {
+			log.Printf("trim: %v", err)
+		}
+		return
+	}
+	defer lf.Close()
+
+	if time.Since(dc.lastRun(trimFile)) < interval {
+		return
+	}
+	if _, err := dc.trim(maxAge); err != nil {
+		log.Printf("trim: %v", err)
+	}
+}
+
+// Trim removes the entries unused for maxAge, except for outputs in use, and
+// returns how many bytes that reclaimed. It waits for any other process
+// sharing the cache to be done evicting or trimming it.
+func (dc *DiskCache) Trim(ctx context.Context, maxAge time.Duration) (int64, error) {
+	lf, err := dc.gcLock(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	defer lf.Close()
+	return dc.trim(maxAge)
+}
+
+func (dc *DiskCache) trim(maxAge time.Duration) (int64, error) {
+	outputs, actions, _, err := dc.scan()
+	if err != nil {
+		return 0, err
+	}
+
+	// An action and its output are touched together on a hit, so they
+	// get old together.
+	cutoff := time.Now().Add(-maxAge)
+	var trimmed int64
+	pinned := dc.pinned()
+	for _, f := range append(actions, outputs...) {
+		if f.mtime.Before(cutoff) && dc.remove(f, pinned) {
+			trimmed += f.size
+		}
+	}
+
+	dc.usage.mu.Lock()
+	dc.usage.size = max(dc.usage.size-trimmed, 0)
+	dc.usage.mu.Unlock()
+
+	return trimmed, dc.recordRun(trimFile)
+}
+
+// lastRun returns when what file records was last done, or the zero time.
+func (dc *DiskCache) lastRun(file string) time.Time {
+	b, err := os.ReadFile(filepath.Join(dc.dir, file))
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+// recordRun records in file that what it is about was just done.
+func (dc *DiskCache) recordRun(file string) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	_, err := dc.writeAtomic(filepath.Join(dc.dir, file), strings.NewReader(now))
+	return err
+}
@@ -6,14 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
-	"runtime"
+	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 
 	"cloud.google.com/go/storage"
 	"github.com/klauspost/compress/s2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
+	"github.com/adambenhassen/gocacheprog/utils"
 )
 
 const (
@@ -24,77 +29,159 @@ const (
 
 type GCSCache struct {
 	bucket        string
-	prefix        string
-	verbose       bool
+	keys          []string // read in order; writes only go to the first
+	prefixes      []string // of the keys
 	client        *storage.Client
 	actioncache   map[string]struct{}
+	outputcache   map[string]struct{} // blobs known to be stored, also under actioncacheMu
 	actioncacheMu sync.RWMutex
+	readFlat      bool
+}
+
+// Options configures a GCSCache.
+type Options struct {
+	// RestoreKeys are read from, in order, for what the cache key doesn't
+	// have.
+	RestoreKeys []string
+
+	// ReadFlat also looks actions up in the flat layout of earlier
+	// versions, which costs every miss a second lookup per key. It can be
+	// turned off once the entries left in that layout no longer matter.
+	ReadFlat bool
 }
 
-func NewCache(ctx context.Context, bucketName string, cacheKey string, verbose bool) *GCSCache {
+// NewCache returns a cache under cacheKey in the bucket.
+func NewCache(ctx context.Context, bucketName string, cacheKey string, opts Options) *GCSCache {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		panic(err)
 	}
 
-	goos := os.Getenv("GOOS")
-	if goos == "" {
-		goos = runtime.GOOS
-	}
-
-	goarch := os.Getenv("GOARCH")
-	if goarch == "" {
-		goarch = runtime.GOARCH
-	}
+	goos, goarch := utils.TargetPlatform()
 
 	cache := &GCSCache{
 		client:      client,
-		verbose:     verbose,
 		bucket:      bucketName,
-		prefix:      fmt.Sprintf("cache/%s/%s/%s", cacheKey, goarch, goos),
+		keys:        append([]string{cacheKey}, opts.RestoreKeys...),
+		readFlat:    opts.ReadFlat,
 		actioncache: map[string]struct{}{},
+		outputcache: map[string]struct{}{},
+	}
+	for _, key := range cache.keys {
+		cache.prefixes = append(cache.prefixes, fmt.Sprintf("cache/%s/%s/%s", key, goarch, goos))
 	}
 	return cache
 }
 
-func (s *GCSCache) Get(ctx context.Context, actionID string) (string, string, int64, io.ReadCloser, error) {
-	actionKey := s.actionKey(actionID)
-	object := s.client.Bucket(s.bucket).Object(actionKey)
-	reader, err := object.NewReader(ctx)
-	if errors.Is(err, storage.ErrObjectNotExist) {
-		return "", "", 0, nil, err
+// GetAction reads the action record, or, if ReadFlat, the object of the action
+// in the flat layout of earlier versions, which holds the output too, under the
+// first key that has either. The key is returned as the Source of the action.
+func (s *GCSCache) GetAction(ctx context.Context, actionID string) (*cachers.Action, error) {
+	for i := range s.prefixes {
+		a, err := s.getAction(ctx, i, actionID)
+		if !errors.Is(err, cachers.ErrNotFound) {
+			return a, err
+		}
 	}
+	return nil, cachers.ErrNotFound
+}
 
-	if err != nil {
-		return "", "", 0, nil, err
+func (s *GCSCache) getAction(ctx context.Context, i int, actionID string) (*cachers.Action, error) {
+	bucket := s.client.Bucket(s.bucket)
+	attrs, err := bucket.Object(s.actionKey(i, actionID)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) && s.readFlat {
+		attrs, err = bucket.Object(s.flatKey(i, actionID)).Attrs(ctx)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, cachers.ErrNotFound
 	}
-
-	attrs, err := object.Attrs(ctx)
 	if err != nil {
-		return "", "", 0, nil, err
+		return nil, err
 	}
 
 	outputID, ok := attrs.Metadata[outputIDMetadataKey]
 	if !ok || outputID == "" {
-		return "", "", 0, nil, err
+		return nil, fmt.Errorf("%w: no %s metadata on %s", cachers.ErrCorrupt, outputIDMetadataKey, attrs.Name)
 	}
 
+	size, err := rawSize(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachers.Action{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     size,
+		Time:     attrs.Updated,
+		Source:   s.keys[i],
+	}, nil
+}
+
+func rawSize(attrs *storage.ObjectAttrs) (int64, error) {
 	sizeStr, ok := attrs.Metadata[outputUncompressedLength]
 	if !ok || sizeStr == "" {
-		return "", "", 0, nil, err
+		return 0, fmt.Errorf("%w: no %s metadata on %s", cachers.ErrCorrupt, outputUncompressedLength, attrs.Name)
 	}
 
 	size, err := strconv.ParseInt(sizeStr, 10, 64)
 	if err != nil {
-		return "", "", 0, nil, err
+		return 0, fmt.Errorf("%w: %v", cachers.ErrCorrupt, err)
+	}
+	return size, nil
+}
+
+// GetOutput reads the output blob, or the object of the action in the flat
+// layout, under the key the action was found under. Both hold it compressed.
+func (s *GCSCache) GetOutput(ctx context.Context, a *cachers.Action) (io.ReadCloser, error) {
+	i := max(slices.Index(s.keys, a.Source), 0)
+	bucket := s.client.Bucket(s.bucket)
+	reader, err := bucket.Object(s.outputKey(i, a.OutputID)).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		reader, err = bucket.Object(s.flatKey(i, a.ActionID)).NewReader(ctx)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, cachers.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return outputID, "", size, io.NopCloser(s2.NewReader(reader)), nil
+	return readCloser{s2.NewReader(reader), reader}, nil
 }
 
-func (s *GCSCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
-	var err error
-	actionKey := s.actionKey(actionID)
+// Stat only finds outputs stored as blobs under the cache key.
+func (s *GCSCache) Stat(ctx context.Context, outputID string) (int64, error) {
+	attrs, err := s.client.Bucket(s.bucket).Object(s.outputKey(0, outputID)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return 0, cachers.ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rawSize(attrs)
+}
+
+// Delete removes the action record, and the object of the action in the flat
+// layout, under the cache key.
+func (s *GCSCache) Delete(ctx context.Context, actionID string) error {
+	s.actioncacheMu.Lock()
+	delete(s.actioncache, actionID)
+	s.actioncacheMu.Unlock()
+
+	bucket := s.client.Bucket(s.bucket)
+	for _, key := range []string{s.actionKey(0, actionID), s.flatKey(0, actionID)} {
+		if err := bucket.Object(key).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put uploads the output blob, unless an action already did, then the action
+// record pointing at it.
+func (s *GCSCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (*cachers.Action, error) {
+	a := &cachers.Action{ActionID: actionID, OutputID: outputID, Size: size}
 
 	if size == 0 {
 		body = bytes.NewReader(nil)
@@ -104,17 +191,18 @@ func (s *GCSCache) Put(ctx context.Context, actionID, outputID string, size int6
 	_, ok := s.actioncache[actionID]
 	s.actioncacheMu.RUnlock()
 	if ok {
-		return "", nil
+		return a, nil
 	}
 
-	object := s.client.Bucket(s.bucket).Object(actionKey)
-	_, err = object.Attrs(ctx)
-	if err == nil {
-		s.actioncacheMu.Lock()
-		s.actioncache[actionID] = struct{}{}
-		s.actioncacheMu.Unlock()
-		//s.Logf("-> PUT %s exists\n", actionID)
-		return "", nil
+	bucket := s.client.Bucket(s.bucket)
+	object := bucket.Object(s.actionKey(0, actionID))
+	if _, err := object.Attrs(ctx); err == nil {
+		s.rememberAction(actionID)
+		return a, nil
+	}
+
+	if err := s.putOutput(ctx, outputID, size, body); err != nil {
+		return nil, err
 	}
 
 	wc := object.NewWriter(ctx)
@@ -123,33 +211,226 @@ func (s *GCSCache) Put(ctx context.Context, actionID, outputID string, size int6
 		outputIDMetadataKey:      outputID,
 		outputUncompressedLength: fmt.Sprint(size),
 	}
+	if err := wc.Close(); err != nil {
+		return nil, err
+	}
+	s.rememberAction(actionID)
+
+	return a, nil
+}
+
+func (s *GCSCache) rememberAction(actionID string) {
+	s.actioncacheMu.Lock()
+	s.actioncache[actionID] = struct{}{}
+	s.actioncacheMu.Unlock()
+}
+
+// putOutput uploads the blob of outputID, compressed, if it isn't there yet.
+func (s *GCSCache) putOutput(ctx context.Context, outputID string, size int64, body io.Reader) error {
+	s.actioncacheMu.RLock()
+	_, ok := s.outputcache[outputID]
+	s.actioncacheMu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	object := s.client.Bucket(s.bucket).Object(s.outputKey(0, outputID))
+	if _, err := object.Attrs(ctx); err == nil {
+		s.rememberOutput(outputID)
+		return nil
+	}
+
+	// Another process may be uploading the same blob: the first one wins.
+	wc := object.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	wc.ContentType = binaryType
+	wc.Metadata = map[string]string{
+		outputUncompressedLength: fmt.Sprint(size),
+	}
 
 	wr := s2.NewWriter(wc)
+	if _, err := io.Copy(wr, body); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wr.Close(); err != nil {
+		wc.Close()
+		return err
+	}
 
-	_, err = io.Copy(wr, body)
-	if err != nil {
-		return "", err
+	var gerr *googleapi.Error
+	if err := wc.Close(); err != nil && !(errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed) {
+		return err
 	}
+	s.rememberOutput(outputID)
+	return nil
+}
 
-	err = wr.Close()
+func (s *GCSCache) rememberOutput(outputID string) {
+	s.actioncacheMu.Lock()
+	s.outputcache[outputID] = struct{}{}
+	s.actioncacheMu.Unlock()
+}
+
+// GetManifest reads the manifest of the first key that has one.
+func (s *GCSCache) GetManifest(ctx context.Context) (io.ReadCloser, error) {
+	var reader *storage.Reader
+	err := storage.ErrObjectNotExist
+	for i := 0; i < len(s.prefixes) && errors.Is(err, storage.ErrObjectNotExist); i++ {
+		reader, err = s.client.Bucket(s.bucket).Object(s.manifestKey(i)).NewReader(ctx)
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	err = wc.Close()
-	if err != nil {
-		return "", err
+	return struct {
+		io.Reader
+		io.Closer
+	}{s2.NewReader(reader), reader}, nil
+}
+
+func (s *GCSCache) PutManifest(ctx context.Context, body io.Reader) error {
+	wc := s.client.Bucket(s.bucket).Object(s.manifestKey(0)).NewWriter(ctx)
+	wc.ContentType = binaryType
+
+	wr := s2.NewWriter(wc)
+	if _, err := io.Copy(wr, body); err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wr.Close(); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// PutPack stores the pack uncompressed, so that outputs can be read from it
+// by range.
+func (s *GCSCache) PutPack(ctx context.Context, name string, index []byte, size int64, body io.Reader) error {
+	if err := s.putObject(ctx, s.packKey(0, name), body); err != nil {
+		return err
+	}
+	return s.putObject(ctx, s.packKey(0, name+".idx"), bytes.NewReader(index))
+}
+
+func (s *GCSCache) putObject(ctx context.Context, key string, body io.Reader) error {
+	wc := s.client.Bucket(s.bucket).Object(key).NewWriter(ctx)
+	wc.ContentType = binaryType
+	if _, err := io.Copy(wc, body); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// ListPacks lists the packs under every key. Those under restore keys are
+// named after the pack and the position of the key, as in name@1.
+func (s *GCSCache) ListPacks(ctx context.Context) ([]string, error) {
+	var names []string
+	for i := range s.prefixes {
+		prefix := s.packKey(i, "")
+		it := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			name, ok := strings.CutSuffix(strings.TrimPrefix(attrs.Name, prefix), ".idx")
+			if !ok {
+				continue
+			}
+			if i > 0 {
+				name = fmt.Sprintf("%s@%d", name, i)
+			}
+			names = append(names, name)
+		}
 	}
+	return names, nil
+}
 
-	return "", nil
+func (s *GCSCache) GetPackIndex(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.GetPackRange(ctx, name+".idx", 0, -1)
 }
 
-func (s *GCSCache) actionKey(actionID string) string {
-	return fmt.Sprintf("%s/%s", s.prefix, actionID)
+func (s *GCSCache) GetPackRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	i := 0
+	if base, n, ok := strings.Cut(name, "@"); ok {
+		i, _ = strconv.Atoi(strings.TrimSuffix(n, ".idx"))
+		if i < 0 || i >= len(s.prefixes) {
+			return nil, cachers.ErrNotFound
+		}
+		name = base + strings.TrimPrefix(n, strconv.Itoa(i))
+	}
+	reader, err := s.client.Bucket(s.bucket).Object(s.packKey(i, name)).NewRangeReader(ctx, offset, length)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, cachers.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// PackSource returns the key the pack name is under, from its @i suffix.
+func (s *GCSCache) PackSource(name string) string {
+	i := 0
+	if _, n, ok := strings.Cut(name, "@"); ok {
+		i, _ = strconv.Atoi(n)
+	}
+	if i < 0 || i >= len(s.keys) {
+		return ""
+	}
+	return s.keys[i]
 }
 
-func (s *GCSCache) Logf(format string, v ...any) {
-	if s.verbose {
-		log.Printf(format, v...)
+// DeletePack deletes a pack under the cache key. Packs under restore keys
+// are left to the runs that write to them.
+func (s *GCSCache) DeletePack(ctx context.Context, name string) error {
+	if strings.Contains(name, "@") {
+		return nil
+	}
+	for _, key := range []string{s.packKey(0, name+".idx"), s.packKey(0, name)} {
+		err := s.client.Bucket(s.bucket).Object(key).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
 	}
+	return nil
+}
+
+// The keys of objects take the position of the cache key they are under.
+
+func (s *GCSCache) actionKey(i int, actionID string) string {
+	return fmt.Sprintf("%s/actions/%s", s.prefixes[i], actionID)
+}
+
+func (s *GCSCache) outputKey(i int, outputID string) string {
+	return fmt.Sprintf("%s/outputs/%s", s.prefixes[i], outputID)
+}
+
+// flatKey is where earlier versions kept an action and its output together.
+func (s *GCSCache) flatKey(i int, actionID string) string {
+	return fmt.Sprintf("%s/%s", s.prefixes[i], actionID)
+}
+
+// manifestKey can't collide with a flat key, which is all hex.
+func (s *GCSCache) manifestKey(i int) string {
+	return fmt.Sprintf("%s/manifest", s.prefixes[i])
+}
+
+// packKey can't collide with a flat key either.
+func (s *GCSCache) packKey(i int, name string) string {
+	return fmt.Sprintf("%s/packs/%s", s.prefixes[i], name)
+}
+
+// readCloser closes the object reader under a decompressing reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
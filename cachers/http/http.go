@@ -3,81 +3,120 @@ package http
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	"github.com/adambenhassen/gocacheprog/cachers"
+	"github.com/adambenhassen/gocacheprog/utils"
 )
 
 type HTTPCache struct {
-	baseURL string       // i.e "http://localhost:31364".
-	client  *http.Client // optional, if nil, http.DefaultClient is used.
-	verbose bool
-	secret  string
+	baseURL  string       // i.e "http://localhost:31364".
+	client   *http.Client // optional, if nil, http.DefaultClient is used.
+	secret   string
+	manifest string // name of the manifest, per cache key and platform
 }
 
-func NewCache(baseURL string, secret string, verbose bool) *HTTPCache {
+func NewCache(baseURL string, secret string, cacheKey string) *HTTPCache {
+	goos, goarch := utils.TargetPlatform()
 	return &HTTPCache{
-		baseURL: baseURL,
-		verbose: verbose,
-		secret:  secret,
+		baseURL:  baseURL,
+		client:   &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		secret:   secret,
+		manifest: fmt.Sprintf("%s-%s-%s", safeName(cacheKey), goarch, goos),
 	}
 }
 
-func (c *HTTPCache) Get(ctx context.Context, actionID string) (string, string, int64, io.ReadCloser, error) {
+// safeName makes key usable in a name the server takes as a file name, such
+// as a branch name with slashes in it. Characters it rejects are replaced,
+// and a hash of key appended so that keys only differing in those, such as
+// feature/foo and feature-foo, stay apart. Keys it accepts are left as is.
+func safeName(key string) string {
+	safe := []byte(key)
+	for i, b := range safe {
+		if !(b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '-' || b == '_' || b == '.') {
+			safe[i] = '-'
+		}
+	}
+	if len(safe) > 0 && safe[0] == '.' {
+		safe[0] = '-'
+	}
+	if string(safe) == key && len(key) <= 100 {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s-%x", safe[:min(len(safe), 100)], sum[:8])
+}
+
+func (c *HTTPCache) GetAction(ctx context.Context, actionID string) (*cachers.Action, error) {
 	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/action/"+actionID, nil)
 	req.Header.Add("secret", c.secret)
 	res, err := c.httpClient().Do(req)
 	if err != nil {
-		return "", "", 0, nil, err
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusNotFound {
-		return "", "", 0, nil, errors.New("not found")
+		return nil, cachers.ErrNotFound
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return "", "", 0, nil, fmt.Errorf("unexpected GET /action/%s status %v", actionID, res.Status)
+		return nil, fmt.Errorf("unexpected GET /action/%s status %v", actionID, res.Status)
 	}
 
 	var av cachers.ActionValue
 	if err := json.NewDecoder(res.Body).Decode(&av); err != nil {
-		return "", "", 0, nil, err
+		return nil, fmt.Errorf("%w: %v", cachers.ErrCorrupt, err)
+	}
+	if av.OutputID == "" {
+		return nil, fmt.Errorf("%w: no outputID for action %s", cachers.ErrCorrupt, actionID)
 	}
 
-	outputID := av.OutputID
-	if av.Size == 0 {
-		return outputID, "", av.Size, io.NopCloser(bytes.NewReader(nil)), nil
+	return &cachers.Action{
+		ActionID: actionID,
+		OutputID: av.OutputID,
+		Size:     av.Size,
+	}, nil
+}
+
+func (c *HTTPCache) GetOutput(ctx context.Context, a *cachers.Action) (io.ReadCloser, error) {
+	if a.Size == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
 	}
 
-	req, _ = http.NewRequestWithContext(ctx, "GET", c.baseURL+"/output/"+outputID, nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/output/"+a.OutputID, nil)
 	req.Header.Add("secret", c.secret)
-	res, err = c.httpClient().Do(req)
+	res, err := c.httpClient().Do(req)
 	if err != nil {
-		return "", "", 0, nil, err
+		return nil, err
 	}
 
 	if res.StatusCode == http.StatusNotFound {
-		return "", "", 0, nil, errors.New("not found")
+		res.Body.Close()
+		return nil, cachers.ErrNotFound
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return "", "", 0, nil, fmt.Errorf("unexpected GET /output/%s status %v", outputID, res.Status)
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected GET /output/%s status %v", a.OutputID, res.Status)
 	}
 
 	if res.ContentLength == -1 {
-		return "", "", 0, nil, fmt.Errorf("no Content-Length from server")
+		res.Body.Close()
+		return nil, fmt.Errorf("no Content-Length from server")
 	}
 
-	return outputID, "", av.Size, res.Body, nil
+	return res.Body, nil
 }
 
-func (c *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+func (c *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (*cachers.Action, error) {
 	var putBody io.Reader
 	if size == 0 {
 		// Special case the empty file so NewRequest sets "Content-Length: 0",
@@ -93,17 +132,187 @@ func (c *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int
 	req.Header.Add("secret", c.secret)
 	res, err := c.httpClient().Do(req)
 	if err != nil {
-		log.Printf("error PUT /%s/%s: %v", actionID, outputID, err)
-		return "", err
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return nil, fmt.Errorf("unexpected PUT /%s/%s status %v: %s", actionID, outputID, res.Status, all)
+	}
+
+	return &cachers.Action{ActionID: actionID, OutputID: outputID, Size: size}, nil
+}
+
+func (c *HTTPCache) Stat(ctx context.Context, outputID string) (int64, error) {
+	req, _ := http.NewRequestWithContext(ctx, "HEAD", c.baseURL+"/output/"+outputID, nil)
+	req.Header.Add("secret", c.secret)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, cachers.ErrNotFound
+	}
+	return 0, fmt.Errorf("unexpected HEAD /output/%s status %v", outputID, res.Status)
+}
+
+func (c *HTTPCache) Delete(ctx context.Context, actionID string) error {
+	req, _ := http.NewRequestWithContext(ctx, "DELETE", c.baseURL+"/action/"+actionID, nil)
+	req.Header.Add("secret", c.secret)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected DELETE /action/%s status %v", actionID, res.Status)
+	}
+	return nil
+}
+
+func (c *HTTPCache) GetManifest(ctx context.Context) (io.ReadCloser, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/manifest/"+c.manifest, nil)
+	req.Header.Add("secret", c.secret)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected GET /manifest/%s status %v", c.manifest, res.Status)
+	}
+
+	return res.Body, nil
+}
+
+func (c *HTTPCache) PutManifest(ctx context.Context, body io.Reader) error {
+	req, _ := http.NewRequestWithContext(ctx, "PUT", c.baseURL+"/manifest/"+c.manifest, body)
+	req.Header.Add("secret", c.secret)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return fmt.Errorf("unexpected PUT /manifest/%s status %v: %s", c.manifest, res.Status, all)
+	}
+
+	return nil
+}
+
+// Packs are kept per cache key and platform, like the manifest.
+func (c *HTTPCache) packURL(name string) string {
+	return c.baseURL + "/pack/" + c.manifest + "/" + name
+}
+
+func (c *HTTPCache) PutPack(ctx context.Context, name string, index []byte, size int64, body io.Reader) error {
+	if err := c.put(ctx, c.packURL(name), size, body); err != nil {
+		return err
+	}
+	return c.put(ctx, c.packURL(name+".idx"), int64(len(index)), bytes.NewReader(index))
+}
+
+func (c *HTTPCache) put(ctx context.Context, url string, size int64, body io.Reader) error {
+	if size == 0 {
+		body = bytes.NewReader(nil)
+	}
+	req, _ := http.NewRequestWithContext(ctx, "PUT", url, body)
+	req.ContentLength = size
+	req.Header.Add("secret", c.secret)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusNoContent {
 		all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
-		return "", fmt.Errorf("unexpected PUT /%s/%s status %v: %s", actionID, outputID, res.Status, all)
+		return fmt.Errorf("unexpected PUT %s status %v: %s", req.URL.Path, res.Status, all)
+	}
+	return nil
+}
+
+func (c *HTTPCache) ListPacks(ctx context.Context) ([]string, error) {
+	rc, err := c.get(ctx, c.packURL(""), "")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
+
+func (c *HTTPCache) GetPackIndex(ctx context.Context, name string) (io.ReadCloser, error) {
+	return c.get(ctx, c.packURL(name+".idx"), "")
+}
+
+func (c *HTTPCache) GetPackRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return c.get(ctx, c.packURL(name), fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+}
+
+func (c *HTTPCache) PackSource(name string) string {
+	return ""
+}
+
+func (c *HTTPCache) DeletePack(ctx context.Context, name string) error {
+	for _, url := range []string{c.packURL(name + ".idx"), c.packURL(name)} {
+		req, _ := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+		req.Header.Add("secret", c.secret)
+		res, err := c.httpClient().Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("unexpected DELETE %s status %v", req.URL.Path, res.Status)
+		}
+	}
+	return nil
+}
+
+// get opens url, or the byte range of it if set.
+func (c *HTTPCache) get(ctx context.Context, url, byteRange string) (io.ReadCloser, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Add("secret", c.secret)
+	want := http.StatusOK
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+		want = http.StatusPartialContent
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, cachers.ErrNotFound
+	}
+
+	if res.StatusCode != want {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected GET %s status %v", req.URL.Path, res.Status)
 	}
 
-	return "", nil
+	return res.Body, nil
 }
 
 func (c *HTTPCache) httpClient() *http.Client {
@@ -0,0 +1,31 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/adambenhassen/gocacheprog/utils"
+)
+
+// Logging logs the calls to the wrapped cache, prefixed by name, with how
+// long they took and how they failed. Misses are too common to be logged.
+func Logging(name string) Middleware {
+	return aroundMiddleware(func(ctx context.Context, call Call, do func(context.Context) error) error {
+		start := time.Now()
+		err := do(ctx)
+		took := utils.FormatDuration(time.Since(start))
+
+		switch {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			log.Printf("%s: %s %s failed, took: %s: %v", name, call.Op, call.Key, took, err)
+		case call.Op == "put" || call.Op == "get_output":
+			log.Printf("%s: %s %s took: %s, size: %v", name, call.Op, call.Key, took, call.Size)
+		default:
+			log.Printf("%s: %s %s took: %s", name, call.Op, call.Key, took)
+		}
+		return err
+	})
+}
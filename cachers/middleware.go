@@ -0,0 +1,308 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/adambenhassen/gocacheprog/stats"
+)
+
+// Middleware decorates a Cache with cross-cutting behavior, such as logging
+// or retries.
+type Middleware func(Cache) Cache
+
+// Chain wraps c in mws, the first of them outermost.
+func Chain(c Cache, mws ...Middleware) Cache {
+	for i := len(mws) - 1; i >= 0; i-- {
+		c = mws[i](c)
+	}
+	return c
+}
+
+// Unwrapper is implemented by middleware, to reach the cache it wraps.
+type Unwrapper interface {
+	Unwrap() Cache
+}
+
+// Find returns the first cache down the chain from c that is a T, to reach
+// the optional interfaces of a backend, such as ManifestStore, through its
+// middleware.
+func Find[T any](c Cache) (T, bool) {
+	for c != nil {
+		if t, ok := c.(T); ok {
+			return t, true
+		}
+		u, ok := c.(Unwrapper)
+		if !ok {
+			break
+		}
+		c = u.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// Call describes a call to a cache as it goes through middleware.
+type Call struct {
+	Op   string // get_action, get_output, put, stat or delete
+	Key  string // the action ID, or the output ID for stat
+	Size int64  // of the output, for puts
+}
+
+// aroundFunc runs do, the call to the wrapped cache, any number of times.
+type aroundFunc func(ctx context.Context, call Call, do func(context.Context) error) error
+
+// around is a Cache that runs every call to next through fn.
+type around struct {
+	next Cache
+	fn   aroundFunc
+}
+
+func aroundMiddleware(fn aroundFunc) Middleware {
+	return func(next Cache) Cache {
+		return &around{next: next, fn: fn}
+	}
+}
+
+func (c *around) Unwrap() Cache { return c.next }
+
+func (c *around) GetAction(ctx context.Context, actionID string) (a *Action, err error) {
+	err = c.fn(ctx, Call{Op: "get_action", Key: actionID}, func(ctx context.Context) error {
+		a, err = c.next.GetAction(ctx, actionID)
+		return err
+	})
+	return a, err
+}
+
+// GetOutput only covers opening the output, not reading it.
+func (c *around) GetOutput(ctx context.Context, a *Action) (rc io.ReadCloser, err error) {
+	err = c.fn(ctx, Call{Op: "get_output", Key: a.ActionID, Size: a.Size}, func(ctx context.Context) error {
+		if rc != nil {
+			rc.Close()
+		}
+		rc, err = c.next.GetOutput(ctx, a)
+		return err
+	})
+	return rc, err
+}
+
+func (c *around) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (a *Action, err error) {
+	rewind := rewinder(body)
+	err = c.fn(ctx, Call{Op: "put", Key: actionID, Size: size}, func(ctx context.Context) error {
+		if err := rewind(); err != nil {
+			return err
+		}
+		a, err = c.next.Put(ctx, actionID, outputID, size, body)
+		return err
+	})
+	return a, err
+}
+
+func (c *around) Stat(ctx context.Context, outputID string) (size int64, err error) {
+	err = c.fn(ctx, Call{Op: "stat", Key: outputID}, func(ctx context.Context) error {
+		size, err = c.next.Stat(ctx, outputID)
+		return err
+	})
+	return size, err
+}
+
+func (c *around) Delete(ctx context.Context, actionID string) error {
+	return c.fn(ctx, Call{Op: "delete", Key: actionID}, func(ctx context.Context) error {
+		return c.next.Delete(ctx, actionID)
+	})
+}
+
+var errNoReplay = errors.New("put body can't be replayed")
+
+// rewinder returns a function that puts body back to where it started
+// before every call but the first, if it can.
+func rewinder(body io.Reader) func() error {
+	calls := 0
+	s, ok := body.(io.Seeker)
+	var start int64
+	if ok {
+		var err error
+		if start, err = s.Seek(0, io.SeekCurrent); err != nil {
+			ok = false
+		}
+	}
+	return func() error {
+		calls++
+		if calls == 1 {
+			return nil
+		}
+		if !ok {
+			return errNoReplay
+		}
+		_, err := s.Seek(start, io.SeekStart)
+		return err
+	}
+}
+
+// Timeout bounds every call to the wrapped cache by d. Outputs have d to be
+// opened and read.
+func Timeout(d time.Duration) Middleware {
+	return func(next Cache) Cache {
+		return &timeout{around: around{next: next, fn: func(ctx context.Context, _ Call, do func(context.Context) error) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return do(ctx)
+		}}, d: d}
+	}
+}
+
+type timeout struct {
+	around
+	d time.Duration
+}
+
+// GetOutput keeps the deadline for reading the output, until it is closed.
+func (c *timeout) GetOutput(ctx context.Context, a *Action) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.d)
+	rc, err := c.next.GetOutput(ctx, a)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return cancelCloser{rc, cancel}, nil
+}
+
+type cancelCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// RateLimit lets at most limit calls a second through to the wrapped cache,
+// in bursts of up to burst.
+func RateLimit(limit float64, burst int) Middleware {
+	l := rate.NewLimiter(rate.Limit(limit), max(burst, 1))
+	return aroundMiddleware(func(ctx context.Context, _ Call, do func(context.Context) error) error {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+		return do(ctx)
+	})
+}
+
+// Retry makes up to attempts calls to the wrapped cache while they fail,
+// backing off exponentially from backoff. Misses, corrupt entries and
+// cancelled calls aren't retried.
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return aroundMiddleware(func(ctx context.Context, _ Call, do func(context.Context) error) error {
+		var err error
+		for i := range max(attempts, 1) {
+			if i > 0 {
+				t := time.NewTimer(backoff << (i - 1))
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return err
+				case <-t.C:
+				}
+			}
+			if err = do(ctx); !retryable(ctx, err) {
+				return err
+			}
+		}
+		return err
+	})
+}
+
+func retryable(ctx context.Context, err error) bool {
+	switch {
+	case err == nil, ctx.Err() != nil:
+		return false
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrCorrupt), errors.Is(err, errors.ErrUnsupported), errors.Is(err, errNoReplay):
+		return false
+	}
+	return true
+}
+
+// Metrics records the calls to the wrapped cache in ops.
+func Metrics(ops *stats.Ops) Middleware {
+	return aroundMiddleware(func(ctx context.Context, call Call, do func(context.Context) error) error {
+		op := ops.Op(call.Op)
+		start := time.Now()
+		err := do(ctx)
+		op.Latency.Since(start)
+		op.Calls.Inc()
+		switch {
+		case errors.Is(err, ErrNotFound):
+			op.NotFound.Inc()
+		case err != nil:
+			op.Errors.Inc()
+		}
+		return err
+	})
+}
+
+// ParseMiddleware parses a comma-separated list of middleware, outermost
+// first:
+//
+//	log                 log every call, under name
+//	metrics             record the calls in ops
+//	retry[=N]           make up to N calls while they fail (default 3)
+//	ratelimit=R[/B]     allow R calls a second, in bursts of B
+//	timeout=D           bound every call by the duration D
+func ParseMiddleware(spec, name string, ops *stats.Ops) ([]Middleware, error) {
+	var mws []Middleware
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, arg, _ := strings.Cut(item, "=")
+
+		var mw Middleware
+		switch kind {
+		case "log":
+			mw = Logging(name)
+		case "metrics":
+			mw = Metrics(ops)
+		case "retry":
+			n := 3
+			if arg != "" {
+				var err error
+				if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+					return nil, fmt.Errorf("middleware %q: want a number of attempts", item)
+				}
+			}
+			mw = Retry(n, 100*time.Millisecond)
+		case "ratelimit":
+			r, b, _ := strings.Cut(arg, "/")
+			limit, err := strconv.ParseFloat(r, 64)
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("middleware %q: want calls per second", item)
+			}
+			burst := 1
+			if b != "" {
+				if burst, err = strconv.Atoi(b); err != nil || burst < 1 {
+					return nil, fmt.Errorf("middleware %q: want a burst size", item)
+				}
+			}
+			mw = RateLimit(limit, burst)
+		case "timeout":
+			d, err := time.ParseDuration(arg)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("middleware %q: want a duration", item)
+			}
+			mw = Timeout(d)
+		default:
+			return nil, fmt.Errorf("unknown middleware %q", kind)
+		}
+		mws = append(mws, mw)
+	}
+	return mws, nil
+}
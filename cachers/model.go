@@ -2,7 +2,19 @@ package cachers
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the cache doesn't have the action or
+	// output asked for, as opposed to failing to answer.
+	ErrNotFound = errors.New("not found")
+
+	// ErrCorrupt is returned when the cache has an entry that can't be
+	// used, such as one with missing or malformed metadata.
+	ErrCorrupt = errors.New("corrupt entry")
 )
 
 // ActionValue is the JSON value returned by the cacher server for an GET /action request.
@@ -11,7 +23,79 @@ type ActionValue struct {
 	Size     int64  `json:"size"`
 }
 
+// Action is what a cache knows about an action: the output it produced.
+type Action struct {
+	ActionID string
+	OutputID string
+	Size     int64
+
+	// Time is when the output was put, if the cache knows.
+	Time time.Time
+
+	// DiskPath is where the output is, for caches on the local disk.
+	DiskPath string
+
+	// Source is where in the cache the action was found, for caches that
+	// read from several places, such as the cache keys of GCS.
+	Source string
+}
+
 type Cache interface {
-	Get(ctx context.Context, actionID string) (outputID, diskpath string, size int64, reader io.ReadCloser, err error)
-	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error)
+	// GetAction looks actionID up, without fetching its output.
+	GetAction(ctx context.Context, actionID string) (*Action, error)
+
+	// GetOutput opens the output of an action returned by GetAction.
+	GetOutput(ctx context.Context, a *Action) (io.ReadCloser, error)
+
+	// Put stores the output of actionID, size bytes read from body.
+	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (*Action, error)
+
+	// Stat returns the size of the output outputID, if the cache can tell
+	// without an action pointing at it, or errors.ErrUnsupported.
+	Stat(ctx context.Context, outputID string) (size int64, err error)
+
+	// Delete removes the entry for actionID. Outputs are left alone, other
+	// actions may share them. Deleting a missing entry is not an error.
+	Delete(ctx context.Context, actionID string) error
+}
+
+// ManifestStore is implemented by remotes that can keep the manifest of the
+// action IDs a build used, so that the next run can prefetch them.
+type ManifestStore interface {
+	GetManifest(ctx context.Context) (io.ReadCloser, error)
+	PutManifest(ctx context.Context, body io.Reader) error
+}
+
+// Locker is implemented by local caches that several processes can share,
+// so that they don't all fetch the same action from the remote at once.
+type Locker interface {
+	// LockAction waits until no other process is fetching actionID, then
+	// holds it until unlock is called.
+	LockAction(ctx context.Context, actionID string) (unlock func(), err error)
+}
+
+// PackStore is implemented by remotes that can keep packs: outputs too small
+// to be worth uploading on their own, uploaded together as one object, with
+// an index to find them by.
+type PackStore interface {
+	// PutPack stores the pack name, size bytes read from body, and then its
+	// index, so that listed packs are complete.
+	PutPack(ctx context.Context, name string, index []byte, size int64, body io.Reader) error
+
+	// ListPacks returns the names of the packs stored.
+	ListPacks(ctx context.Context) ([]string, error)
+
+	// GetPackIndex opens the index of the pack name.
+	GetPackIndex(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// GetPackRange opens length bytes of the pack name from offset.
+	GetPackRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+
+	// PackSource returns where in the cache the pack name is, as the Source
+	// of the actions in it.
+	PackSource(name string) string
+
+	// DeletePack removes the pack name and its index, the index first so
+	// that the pack is no longer listed.
+	DeletePack(ctx context.Context, name string) error
 }
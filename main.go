@@ -1,9 +1,16 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/adambenhassen/gocacheprog/cachers"
@@ -12,21 +19,62 @@ import (
 	"github.com/adambenhassen/gocacheprog/cachers/http"
 	"github.com/adambenhassen/gocacheprog/proc"
 	"github.com/adambenhassen/gocacheprog/server"
+	"github.com/adambenhassen/gocacheprog/stats"
+	"github.com/adambenhassen/gocacheprog/tracing"
 	"github.com/adambenhassen/gocacheprog/utils"
 )
 
 // Common Settings
 var (
-	verbose  = flag.Bool("verbose", true, "Activates verbose output for detailed logging.")
-	cachedir = flag.String("cache-dir", "", "Specifies the directory used for caching.")
+	verbose   = flag.Bool("verbose", true, "Activates verbose output for detailed logging.")
+	cachedir  = flag.String("cache-dir", "", "Specifies the directory used for caching.")
+	cacheMax  = flag.Int64("cache-max-size", 0, "Evicts the least recently used entries from the cache dir once it holds more than this many bytes. (0 for no limit)")
+	trimAge   = flag.Duration("trim-age", disk.DefaultTrimAge, "Trims the entries of the cache dir unused for this long, on startup, like cmd/go does. (0 disables)")
+	trimEvery = flag.Duration("trim-interval", disk.DefaultTrimInterval, "Trims the cache dir at most this often, across the processes sharing it.")
+	durable   = flag.Bool("durable", false, "Syncs cache dir writes to disk before using them, so that entries survive a power loss.")
+	statsFile = flag.String("stats-file", os.Getenv("GOCACHEPROG_STATS_FILE"), "Writes run statistics as JSON to this file on exit. (env GOCACHEPROG_STATS_FILE)")
+	traceDest = flag.String("trace", os.Getenv("GOCACHEPROG_TRACE"), "Exports request traces: \"otlp\" for OTLP/HTTP (configured by OTEL_EXPORTER_OTLP_*), or a file path for JSON spans. (env GOCACHEPROG_TRACE)")
+)
+
+// Middleware, outermost first: log, metrics, retry[=N], ratelimit=R[/B], timeout=D.
+// With -verbose, log is added in front of the remote ones.
+var (
+	localMiddleware  = flag.String("local-middleware", "metrics", "Wraps the local disk cache in these comma-separated middleware.")
+	remoteMiddleware = flag.String("remote-middleware", "metrics", "Wraps every remote tier in these comma-separated middleware, e.g. \"metrics,retry=3,timeout=1m\".")
 )
 
 // Client Configuration
 var (
+	remoteMode    = flag.String("remote-mode", cmp.Or(os.Getenv("GOCACHEPROG_REMOTE_MODE"), "rw"), "Restricts the remote tiers: rw reads and writes, ro only reads, wo only writes. (env GOCACHEPROG_REMOTE_MODE)")
+	tierSpecs     = flag.String("tiers", "", "Chains remote caches below the local disk, fastest first, comma-separated: URL[=through|behind|never]. URLs are http(s):// for a cache server or gs://bucket[/cache-key]. Writes default to behind. (When empty, -http or else -bucket is the only tier)")
 	httpServerURL = flag.String("http", "", "Provides the URL for the HTTP server. (When empty, GCS mode is enabled by default)")
 	gcsBucket     = flag.String("bucket", "inigo-ci-cache", "Designates the target Google Cloud Storage bucket.")
 	gcsCacheKey   = flag.String("cache-key", "main", "Sets a unique identifier for the cache, customizable to any name.")
+	restoreKeys   = flag.String("restore-keys", os.Getenv("GOCACHEPROG_RESTORE_KEYS"), "Falls back to reading GCS from these comma-separated cache keys, in order, e.g. \"main\". Writes only go to -cache-key. (env GOCACHEPROG_RESTORE_KEYS)")
+	gcsReadFlat   = flag.Bool("gcs-read-flat", true, "Also reads GCS entries in the layout of versions before outputs were shared, at the cost of a second lookup per miss.")
 	minUploadSize = flag.Int64("min-upload-size", 15_000, "Defines the minimum file size for uploads, measured in bytes.")
+	packSize      = flag.Int64("pack-size", 8<<20, "Uploads outputs under -min-upload-size in packs of this many bytes, and on exit. (0 disables)")
+	packMaxAge    = flag.Duration("pack-max-age", 7*24*time.Hour, "Reads packs for this long after they were made, then deletes them from the tiers written to. (0 keeps them)")
+	negativeTTL   = flag.Duration("negative-cache-ttl", time.Hour, "Remembers remote misses for this long to skip asking again. (0 disables)")
+	prefetch      = flag.Int("prefetch-workers", 16, "Prefetches the entries the last run with this cache key used, this many at a time. (0 disables)")
+	closeTimeout  = flag.Duration("close-timeout", time.Minute, "Bounds how long pending uploads are flushed on exit before being abandoned. (0 waits indefinitely)")
+	getTimeout    = flag.Duration("get-timeout", 30*time.Second, "Bounds each remote get, download included. (0 waits indefinitely)")
+)
+
+// Remote Health
+var (
+	breakerFailures = flag.Int("breaker-failures", 5, "Stops consulting the remote after this many failed or slow calls in a row. (0 never stops)")
+	breakerLatency  = flag.Duration("breaker-latency", 10*time.Second, "Counts remote gets slower than this as failures. (0 ignores latency)")
+	breakerProbe    = flag.Duration("breaker-probe", 30*time.Second, "Sets how often the remote is probed while it isn't consulted.")
+)
+
+// Upload Queue
+var (
+	uploadWorkers    = flag.Int("upload-workers", 16, "Sets the number of concurrent background uploads.")
+	uploadQueueBytes = flag.Int64("upload-queue-bytes", 4<<30, "Caps the total size of outputs waiting to be uploaded. (0 for no limit)")
+	uploadQueueLen   = flag.Int("upload-queue-entries", 10_000, "Caps the number of outputs waiting to be uploaded. (0 for no limit)")
+	uploadQueueFull  = flag.String("upload-queue-full", "drop", "Chooses what a put does when the upload queue is full: block or drop.")
+	uploadTimeout    = flag.Duration("upload-timeout", 5*time.Minute, "Bounds each upload. (0 waits indefinitely)")
 )
 
 // Server Settings
@@ -39,34 +87,210 @@ var (
 func main() {
 	flag.Parse()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	// Restore the default handling after the first signal, so that a second
+	// one kills a process stuck flushing.
+	context.AfterFunc(ctx, cancel)
+
+	shutdownTracing, err := tracing.Setup(ctx, *traceDest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Server mode to server http
 	if *serverMode {
-		server.Run(ctx, *listen, *secret, *cachedir, *verbose)
+		server.Run(ctx, *listen, *secret, *cachedir, diskOptions(), *verbose)
 		return
 	}
 
+	whenFull, err := proc.ParseQueueFullPolicy(*uploadQueueFull)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mode, err := proc.ParseRemoteMode(*remoteMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	st := stats.New()
+
 	// Local disk
-	local := disk.NewCache(ctx, *cachedir, *verbose)
+	if flag.Arg(0) == "trim" {
+		// Trim now, without the remote tiers
+		if *trimAge <= 0 {
+			log.Fatal("trim: -trim-age must be positive")
+		}
+		dc, err := disk.NewCache(ctx, *cachedir, disk.Options{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := dc.Trim(ctx, *trimAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("trimmed %s", utils.FormatBytes(n))
+		return
+	}
+	if flag.Arg(0) == "migrate" {
+		// Move a flat cache dir over to subdirectories
+		dc, err := disk.NewCache(ctx, *cachedir, disk.Options{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := dc.Migrate(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("migrated %d entries", n)
+		return
+	}
+	dc, err := disk.NewCache(ctx, *cachedir, diskOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	local, err := wrap(dc, *localMiddleware, "local", &st.LocalOps, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tiers := []proc.Tier{{Name: "local", Cache: local, Write: proc.WriteThrough}}
 
-	// Remote
-	var remote cachers.Cache
-	if *httpServerURL != "" {
-		log.Println("HTTP Mode")
-		remote = http.NewCache(*httpServerURL, *secret, *verbose)
-	} else {
-		log.Println("GCS Mode")
-		remote = gcs.NewCache(ctx, *gcsBucket, *gcsCacheKey, *verbose)
+	// Remote tiers
+	specs := *tierSpecs
+	if specs == "" {
+		specs = *httpServerURL
+		if specs == "" {
+			specs = "gs://" + *gcsBucket + "/" + *gcsCacheKey
+		}
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		t, err := newTier(ctx, spec, st)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Tier %s, write %s", t.Name, t.Write)
+		tiers = append(tiers, t)
+	}
+
+	p, err := proc.NewCacheProc(tiers, proc.Options{
+		Verbose:          *verbose,
+		MinUploadSize:    *minUploadSize,
+		Dir:              dc.Dir(),
+		StatsFile:        *statsFile,
+		Stats:            st,
+		RemoteMode:       mode,
+		PackSize:         *packSize,
+		PackMaxAge:       *packMaxAge,
+		NegativeCacheTTL: *negativeTTL,
+		PrefetchWorkers:  *prefetch,
+		CloseTimeout:     *closeTimeout,
+		GetTimeout:       *getTimeout,
+		Breaker: proc.BreakerOptions{
+			Failures:      *breakerFailures,
+			Latency:       *breakerLatency,
+			ProbeInterval: *breakerProbe,
+		},
+		Upload: proc.UploadOptions{
+			Workers:    *uploadWorkers,
+			MaxBytes:   *uploadQueueBytes,
+			MaxEntries: *uploadQueueLen,
+			WhenFull:   whenFull,
+			Timeout:    *uploadTimeout,
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Start running
 	start := time.Now()
-	proc.NewCacheProc(local, remote, *verbose, *minUploadSize).Run(ctx)
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		// Start running
+		err = p.Run(ctx)
+	case "flush":
+		// Upload what earlier runs left behind
+		p.Flush()
+	default:
+		log.Fatalf("unknown command %q", cmd)
+	}
 
 	// Report run time
 	if *verbose {
 		log.Println("took", utils.FormatDuration(time.Since(start)))
 	}
+
+	// Pending uploads are flushed by now; cmd/go needs to see we failed.
+	if err != nil {
+		shutdownTracing(context.Background())
+		os.Exit(1)
+	}
+}
+
+func diskOptions() disk.Options {
+	return disk.Options{
+		MaxSize:      *cacheMax,
+		TrimAge:      *trimAge,
+		TrimInterval: *trimEvery,
+		Durable:      *durable,
+		PinOutputs:   !*serverMode,
+	}
+}
+
+// wrap wraps c in the middleware of spec, and in logging if verbose and c is
+// remote. Local gets are too many, misses included, to be worth logging.
+func wrap(c cachers.Cache, spec, name string, ops *stats.Ops, remote bool) (cachers.Cache, error) {
+	if *verbose && remote {
+		spec = "log," + spec
+	}
+	mws, err := cachers.ParseMiddleware(spec, name, ops)
+	if err != nil {
+		return nil, err
+	}
+	return cachers.Chain(c, mws...), nil
+}
+
+// newTier returns the remote tier spec describes: a cache URL, optionally
+// followed by =policy.
+func newTier(ctx context.Context, spec string, st *stats.Stats) (proc.Tier, error) {
+	t := proc.Tier{Name: spec, Write: proc.WriteBehind}
+	if i := strings.LastIndex(spec, "="); i >= 0 {
+		if w, err := proc.ParseWritePolicy(spec[i+1:]); err == nil {
+			t.Name, t.Write = spec[:i], w
+		}
+	}
+
+	u, err := url.Parse(t.Name)
+	if err != nil {
+		return t, fmt.Errorf("tier %q: %w", spec, err)
+	}
+
+	var c cachers.Cache
+	switch u.Scheme {
+	case "http", "https":
+		c = http.NewCache(t.Name, *secret, *gcsCacheKey)
+	case "gs":
+		key := strings.Trim(u.Path, "/")
+		if key == "" {
+			key = *gcsCacheKey
+		}
+		t.Name = "gs://" + u.Host + "/" + key
+		var fallbacks []string
+		for _, k := range strings.Split(*restoreKeys, ",") {
+			if k = strings.TrimSpace(k); k != "" && k != key {
+				fallbacks = append(fallbacks, k)
+			}
+		}
+		c = gcs.NewCache(ctx, u.Host, key, gcs.Options{RestoreKeys: fallbacks, ReadFlat: *gcsReadFlat})
+	default:
+		return t, fmt.Errorf("tier %q: want an http(s):// or gs:// URL", spec)
+	}
+
+	if t.Cache, err = wrap(c, *remoteMiddleware, t.Name, &st.RemoteOps, true); err != nil {
+		return t, err
+	}
+	return t, nil
 }
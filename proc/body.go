@@ -0,0 +1,110 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	errNoBody       = errors.New("put body missing")
+	errUnterminated = errors.New("unterminated string literal")
+)
+
+// bodyReader streams the body of a put request as it arrives on stdin.
+//
+// cmd/go sends the body right after the request as a base64-encoded JSON
+// string literal on its own line. bodyReader decodes it on the fly so the
+// body never has to be held in memory as a whole.
+type bodyReader struct {
+	dec io.Reader
+	q   *quotedReader
+	n   int64
+}
+
+// newBodyReader starts reading the body literal from br. It returns
+// errNoBody, without consuming anything else, if what follows is not a
+// string literal, so that it can be read as the next request.
+func newBodyReader(br *bufio.Reader) (*bodyReader, error) {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading put body: %w", err)
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			q := &quotedReader{br: br}
+			return &bodyReader{dec: base64.NewDecoder(base64.StdEncoding, q), q: q}, nil
+		default:
+			br.UnreadByte()
+			return nil, errNoBody
+		}
+	}
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.dec.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// Drain consumes whatever is left of the body up to its closing quote, so the
+// next request can be read, and returns the total number of decoded bytes
+// and the first error decoding them. If the body is not valid base64, the
+// rest of the literal is skipped all the same.
+func (b *bodyReader) Drain() (int64, error) {
+	_, err := io.Copy(io.Discard, b)
+	if err != nil {
+		io.Copy(io.Discard, b.q)
+	}
+	return b.n, err
+}
+
+// Resynced reports whether the whole body literal was consumed, so that the
+// next request can be read, even if the body itself was bad.
+func (b *bodyReader) Resynced() bool {
+	return b.q.done
+}
+
+// quotedReader reads from br up to, and consuming, the closing quote of a
+// JSON string literal. JSON strings can't span lines, so it gives up on a
+// literal at the end of its line.
+type quotedReader struct {
+	br   *bufio.Reader
+	done bool
+}
+
+func (q *quotedReader) Read(p []byte) (int, error) {
+	if q.done {
+		return 0, io.EOF
+	}
+
+	if q.br.Buffered() == 0 {
+		if _, err := q.br.Peek(1); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+
+	buf, _ := q.br.Peek(min(len(p), q.br.Buffered()))
+	if i := bytes.IndexAny(buf, "\"\n"); i >= 0 {
+		n := copy(p, buf[:i])
+		q.br.Discard(i + 1)
+		q.done = true
+		if buf[i] == '\n' {
+			return n, errUnterminated
+		}
+		return n, nil
+	}
+
+	n := copy(p, buf)
+	q.br.Discard(n)
+	return n, nil
+}
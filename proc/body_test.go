@@ -0,0 +1,198 @@
+package proc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/adambenhassen/gocacheprog/stats"
+	"github.com/adambenhassen/gocacheprog/wire"
+)
+
+func TestBodyReader(t *testing.T) {
+	body := strings.Repeat("gocacheprog ", 100)
+	lit := `"` + base64.StdEncoding.EncodeToString([]byte(body)) + `"`
+
+	tests := []struct {
+		name     string
+		in       string
+		split    bool // deliver the input a byte at a time
+		want     string
+		err      error // from newBodyReader
+		readErr  bool  // from Drain
+		resynced bool
+	}{
+		{name: "whole", in: lit + "\n", want: body, resynced: true},
+		{name: "split", in: lit + "\n", split: true, want: body, resynced: true},
+		{name: "leading space", in: " \n" + lit + "\n", want: body, resynced: true},
+		{name: "empty", in: `""` + "\n", resynced: true},
+		// The next line is a request again.
+		{name: "unterminated", in: lit[:len(lit)-1] + "\n", readErr: true, resynced: true},
+		{name: "unterminated split", in: lit[:len(lit)-1] + "\n", split: true, readErr: true, resynced: true},
+		{name: "end of input", in: lit[:len(lit)-1], readErr: true},
+		{name: "bad base64", in: `"@@@@` + lit[1:] + "\n", readErr: true, resynced: true},
+		{name: "no body", in: `{"ID":2}` + "\n", err: errNoBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = strings.NewReader(tt.in)
+			if tt.split {
+				r = iotest.OneByteReader(r)
+			}
+			br := bufio.NewReaderSize(r, 16)
+
+			b, err := newBodyReader(br)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("newBodyReader: got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				// What follows has to be left for the next request.
+				if rest, _ := io.ReadAll(br); string(rest) != tt.in {
+					t.Errorf("consumed input: %q left of %q", rest, tt.in)
+				}
+				return
+			}
+
+			got, err := io.ReadAll(b)
+			if (err != nil) != tt.readErr {
+				t.Fatalf("reading body: got error %v, want error: %v", err, tt.readErr)
+			}
+			if _, derr := b.Drain(); (derr != nil) != tt.readErr && err == nil {
+				t.Errorf("Drain: got error %v, want error: %v", derr, tt.readErr)
+			}
+			if !tt.readErr && string(got) != tt.want {
+				t.Errorf("got body %q, want %q", got, tt.want)
+			}
+			if b.Resynced() != tt.resynced {
+				t.Errorf("Resynced() = %v, want %v", b.Resynced(), tt.resynced)
+			}
+			if tt.resynced {
+				if rest, _ := io.ReadAll(br); len(strings.TrimSpace(string(rest))) != 0 {
+					t.Errorf("input left after the body: %q", rest)
+				}
+			}
+		})
+	}
+}
+
+func TestReadRequests(t *testing.T) {
+	enc := func(s string) string {
+		return `"` + base64.StdEncoding.EncodeToString([]byte(s)) + `"` + "\n"
+	}
+	put := func(id, size int) string {
+		return fmt.Sprintf(`{"ID":%d,"Command":"put","ActionID":"YQ==","OutputID":"bw==","BodySize":%d}`+"\n", id, size)
+	}
+	get := func(id int) string {
+		return fmt.Sprintf(`{"ID":%d,"Command":"get","ActionID":"YQ=="}`+"\n", id)
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    map[int64]bool // request ID -> answered with an error
+		bodies  map[int64]string
+		wantErr bool
+	}{
+		{
+			name:   "put and get",
+			in:     put(1, 5) + enc("hello") + get(2),
+			want:   map[int64]bool{1: false, 2: false},
+			bodies: map[int64]string{1: "hello"},
+		},
+		{
+			name: "size mismatch",
+			in:   put(1, 6) + enc("hello") + get(2),
+			want: map[int64]bool{1: true, 2: false},
+		},
+		{
+			name: "bad base64",
+			in:   put(1, 5) + `"@@@@@@@@"` + "\n" + get(2),
+			want: map[int64]bool{1: true, 2: false},
+		},
+		{
+			name: "missing body",
+			in:   put(1, 5) + get(2),
+			want: map[int64]bool{1: true, 2: false},
+		},
+		{
+			name: "malformed request followed by a body",
+			in:   `{"ID":1,"Command":"put","ActionID":"!!"}` + "\n" + enc("hello") + get(2),
+			want: map[int64]bool{1: true, 2: false},
+		},
+		{
+			name: "malformed request without a body",
+			in:   `{"ID":1,"Command":"get","ActionID":"!!"}` + "\n" + get(2),
+			want: map[int64]bool{1: true, 2: false},
+		},
+		{
+			name: "unterminated body",
+			in:   put(1, 5) + `"aGVsbG8` + "\n" + get(2),
+			want: map[int64]bool{1: true, 2: false},
+		},
+		{
+			name:    "body cut short",
+			in:      put(1, 5) + `"aGVsbG8`,
+			want:    map[int64]bool{},
+			wantErr: true,
+		},
+		{
+			name:    "malformed request without an ID",
+			in:      `{"Command":` + "\n" + get(2),
+			want:    map[int64]bool{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Process{
+				stats:    stats.New(),
+				handlers: map[wire.Cmd]handlerFunc{wire.CmdGet: nil, wire.CmdPut: nil, wire.CmdClose: nil},
+			}
+
+			var mu sync.Mutex
+			got := map[int64]bool{}
+			bodies := map[int64]string{}
+			handle := func(req *wire.Request, _ *func()) *wire.Response {
+				if req.Body != nil {
+					b, _ := io.ReadAll(req.Body)
+					mu.Lock()
+					bodies[req.ID] = string(b)
+					mu.Unlock()
+				}
+				return &wire.Response{ID: req.ID}
+			}
+			reply := func(res *wire.Response) {
+				mu.Lock()
+				defer mu.Unlock()
+				if _, ok := got[res.ID]; ok {
+					t.Errorf("request %d answered twice", res.ID)
+				}
+				got[res.ID] = res.Err != ""
+			}
+
+			var wg errgroup.Group
+			err := p.readRequests(bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(tt.in)), 16), &wg, handle, reply)
+			wg.Wait()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readRequests: got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got replies (ID:failed) %v, want %v", got, tt.want)
+			}
+			for id, want := range tt.bodies {
+				if bodies[id] != want {
+					t.Errorf("request %d: got body %q, want %q", id, bodies[id], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package proc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adambenhassen/gocacheprog/stats"
+	"github.com/adambenhassen/gocacheprog/utils"
+)
+
+var errRemoteUnavailable = errors.New("remote unavailable")
+
+// BreakerOptions configures when the remote is given up on for a while.
+type BreakerOptions struct {
+	// Failures is how many remote calls in a row may fail, or be slower
+	// than Latency, before the remote is no longer consulted. Zero never
+	// gives up on the remote.
+	Failures int
+
+	// Latency is how long a remote get may take before it counts as a
+	// failure. Zero doesn't judge gets by their latency.
+	Latency time.Duration
+
+	// ProbeInterval is how often the remote is tried again while the
+	// breaker is open.
+	ProbeInterval time.Duration
+}
+
+// breaker stops proc from waiting on a remote that keeps failing or is too
+// slow to be worth it, so that builds carry on from the local cache alone.
+// While open, it probes the remote in the background and closes again once
+// the remote answers in time.
+type breaker struct {
+	name    string // of the remote, in logs and events
+	opts    BreakerOptions
+	timeout time.Duration // bounds each probe
+	probe   func(ctx context.Context) error
+	stats   *stats.Stats
+	verbose bool
+
+	mu     sync.Mutex
+	bad    int // consecutive failed or slow calls
+	open   bool
+	closed bool
+	stop   chan struct{}
+}
+
+func newBreaker(name string, opts BreakerOptions, timeout time.Duration, probe func(context.Context) error, st *stats.Stats, verbose bool) *breaker {
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = 30 * time.Second
+	}
+	if timeout <= 0 {
+		timeout = opts.ProbeInterval
+	}
+	return &breaker{
+		name:    name,
+		opts:    opts,
+		timeout: timeout,
+		probe:   probe,
+		stats:   st,
+		verbose: verbose,
+		stop:    make(chan struct{}),
+	}
+}
+
+// allow reports whether the remote should be consulted.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open
+}
+
+// done records the outcome of a remote call that took took. ctx is the
+// context of the caller, before the per-call timeout: calls cut short by the
+// caller going away say nothing about the remote. A zero took is not judged
+// by its latency.
+func (b *breaker) done(ctx context.Context, err error, took time.Duration) {
+	if ctx.Err() != nil {
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		b.stats.RemoteTimeouts.Inc()
+	}
+
+	slow := b.opts.Latency > 0 && took > b.opts.Latency
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil && !slow {
+		b.bad = 0
+		return
+	}
+
+	b.bad++
+	if b.open || b.closed || b.opts.Failures <= 0 || b.bad < b.opts.Failures {
+		return
+	}
+
+	reason := fmt.Sprintf("%d calls in a row failed, last: %v", b.bad, err)
+	if err == nil {
+		reason = fmt.Sprintf("%d calls in a row failed, last took %s", b.bad, utils.FormatDuration(took))
+	}
+	b.open = true
+	b.stats.BreakerOpened.Inc()
+	b.stats.Breaker.Add(b.name, "open", reason)
+	log.Printf("%s: breaker open, no longer consulted: %s", b.name, reason)
+
+	go b.probeUntilHealthy()
+}
+
+// probeUntilHealthy probes the remote every probe interval until it answers
+// in time, then closes the breaker.
+func (b *breaker) probeUntilHealthy() {
+	t := time.NewTicker(b.opts.ProbeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		start := time.Now()
+		err := b.probe(ctx)
+		took := time.Since(start)
+		cancel()
+
+		if err != nil || (b.opts.Latency > 0 && took > b.opts.Latency) {
+			if b.verbose {
+				log.Printf("%s: probe failed, took %s: %v", b.name, utils.FormatDuration(took), err)
+			}
+			continue
+		}
+
+		b.mu.Lock()
+		b.open = false
+		b.bad = 0
+		b.stats.Breaker.Add(b.name, "closed", fmt.Sprintf("probe answered in %s", utils.FormatDuration(took)))
+		b.mu.Unlock()
+
+		log.Printf("%s: breaker closed, answered in %s", b.name, utils.FormatDuration(took))
+		return
+	}
+}
+
+// close stops probing. The breaker doesn't open again afterwards.
+func (b *breaker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.stop)
+	}
+}
@@ -0,0 +1,263 @@
+package proc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/adambenhassen/gocacheprog/cachers/disk"
+)
+
+const (
+	journalOpAdd  = "add"
+	journalOpDone = "done"
+)
+
+type journalEntry struct {
+	Op       string `json:"op"`
+	Tier     string `json:"t,omitempty"` // empty in journals from before tiers
+	ActionID string `json:"a"`
+	OutputID string `json:"o"`
+	Size     int64  `json:"n,omitempty"`
+	Path     string `json:"p,omitempty"`
+}
+
+// journal records uploads that haven't reached the remote yet, so that a
+// later run, or `gocacheprog flush`, can resume them from the local disk
+// cache. Each process appends to its own file under <dir>/journal, locked
+// for as long as it runs, and removes it once nothing is left pending.
+type journal struct {
+	dir  string
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	pending map[journalKey]struct{}
+}
+
+type journalKey struct {
+	tier string
+	uploadKey
+}
+
+func openJournal(dir string) (*journal, error) {
+	dir = filepath.Join(dir, "journal")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Lock the journal before it is named for others to claim.
+	f, err := os.CreateTemp(dir, "new-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "uploads-"+strings.TrimPrefix(filepath.Base(f.Name()), "new-"))
+	if _, err := disk.TryLock(f); err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &journal{
+		dir:     dir,
+		path:    path,
+		f:       f,
+		w:       bufio.NewWriter(f),
+		pending: map[journalKey]struct{}{},
+	}, nil
+}
+
+// add records that the output at path has to be uploaded to tier for
+// actionID.
+func (j *journal) add(tier, actionID, outputID string, size int64, path string) error {
+	if j == nil {
+		return nil
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := journalKey{tier, uploadKey{actionID, outputID}}
+	if _, ok := j.pending[key]; ok {
+		return nil
+	}
+	j.pending[key] = struct{}{}
+	return j.write(journalEntry{Op: journalOpAdd, Tier: tier, ActionID: actionID, OutputID: outputID, Size: size, Path: path})
+}
+
+// done records that the upload of outputID to tier for actionID completed.
+func (j *journal) done(tier, actionID, outputID string) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := journalKey{tier, uploadKey{actionID, outputID}}
+	if _, ok := j.pending[key]; !ok {
+		return
+	}
+	delete(j.pending, key)
+	j.write(journalEntry{Op: journalOpDone, Tier: tier, ActionID: actionID, OutputID: outputID})
+}
+
+func (j *journal) write(e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	// Flush every entry: the point of the journal is to survive the
+	// process being killed at any moment.
+	if _, err := j.w.Write(b); err == nil {
+		err = j.w.Flush()
+	}
+	if err != nil {
+		log.Printf("journal: %v", err)
+	}
+	return err
+}
+
+// claim takes over the journals left behind by earlier runs and returns the
+// uploads they still had pending. The entries are carried over into this
+// run's journal, so they aren't lost if this run is cut short too; a journal
+// that couldn't be read or carried over whole is put back for the next run.
+// Journals still locked belong to processes running alongside, and are left
+// to them.
+func (j *journal) claim() ([]journalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	own := filepath.Base(j.path)
+
+	var pending []journalEntry
+	for _, fi := range files {
+		name := fi.Name()
+		if name == own || !strings.HasPrefix(name, "uploads-") || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(j.dir, name))
+		if err != nil {
+			continue
+		}
+		if ok, err := disk.TryLock(f); !ok || err != nil {
+			f.Close()
+			continue
+		}
+
+		// Renaming is atomic, so when several processes start at once
+		// only one of them gets to replay a given journal.
+		claimed := filepath.Join(j.dir, "claimed-"+name)
+		err = os.Rename(filepath.Join(j.dir, name), claimed)
+		f.Close()
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("journal: %v", err)
+			}
+			continue
+		}
+
+		entries, err := readJournal(claimed)
+		if err != nil {
+			log.Printf("journal: %s: %v", name, err)
+		}
+		for _, e := range entries {
+			if aerr := j.add(e.Tier, e.ActionID, e.OutputID, e.Size, e.Path); err == nil {
+				err = aerr
+			}
+		}
+		pending = append(pending, entries...)
+
+		if err != nil {
+			os.Rename(claimed, filepath.Join(j.dir, name))
+			continue
+		}
+		os.Remove(claimed)
+	}
+	return pending, nil
+}
+
+// close removes the journal if every upload it recorded went through.
+func (j *journal) close() (pending int) {
+	if j == nil {
+		return 0
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.w.Flush()
+	j.f.Close()
+
+	if len(j.pending) == 0 {
+		os.Remove(j.path)
+	}
+	return len(j.pending)
+}
+
+// readJournal replays the journal at path and returns the uploads that were
+// added but never marked done. A torn last line from a killed process is
+// ignored.
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []journalKey
+	adds := map[journalKey]journalEntry{}
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+
+		key := journalKey{e.Tier, uploadKey{e.ActionID, e.OutputID}}
+		switch e.Op {
+		case journalOpAdd:
+			if _, ok := adds[key]; !ok {
+				order = append(order, key)
+			}
+			adds[key] = e
+		case journalOpDone:
+			delete(adds, key)
+		}
+	}
+
+	var pending []journalEntry
+	for _, key := range order {
+		if e, ok := adds[key]; ok {
+			pending = append(pending, e)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return pending, fmt.Errorf("reading journal: %w", err)
+	}
+	return pending, nil
+}
@@ -0,0 +1,83 @@
+package proc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadJournal(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []journalEntry
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "pending in order",
+			in: `{"op":"add","t":"gcs","a":"a2","o":"o2","n":2,"p":"/c/o2"}
+{"op":"add","t":"gcs","a":"a1","o":"o1","n":1,"p":"/c/o1"}
+`,
+			want: []journalEntry{
+				{Op: journalOpAdd, Tier: "gcs", ActionID: "a2", OutputID: "o2", Size: 2, Path: "/c/o2"},
+				{Op: journalOpAdd, Tier: "gcs", ActionID: "a1", OutputID: "o1", Size: 1, Path: "/c/o1"},
+			},
+		},
+		{
+			name: "done",
+			in: `{"op":"add","t":"gcs","a":"a1","o":"o1","n":1,"p":"/c/o1"}
+{"op":"add","t":"gcs","a":"a2","o":"o2","n":2,"p":"/c/o2"}
+{"op":"done","t":"gcs","a":"a1","o":"o1"}
+`,
+			want: []journalEntry{
+				{Op: journalOpAdd, Tier: "gcs", ActionID: "a2", OutputID: "o2", Size: 2, Path: "/c/o2"},
+			},
+		},
+		{
+			name: "done for another tier",
+			in: `{"op":"add","t":"gcs","a":"a1","o":"o1","n":1,"p":"/c/o1"}
+{"op":"done","t":"http","a":"a1","o":"o1"}
+`,
+			want: []journalEntry{
+				{Op: journalOpAdd, Tier: "gcs", ActionID: "a1", OutputID: "o1", Size: 1, Path: "/c/o1"},
+			},
+		},
+		{
+			name: "torn last line",
+			in: `{"op":"add","t":"gcs","a":"a1","o":"o1","n":1,"p":"/c/o1"}
+{"op":"add","t":"gcs","a":"a2","o":"o2","n":2,"p":"/c/o2"}
+{"op":"done","t":"gcs","a":"a2","o":`,
+			want: []journalEntry{
+				{Op: journalOpAdd, Tier: "gcs", ActionID: "a1", OutputID: "o1", Size: 1, Path: "/c/o1"},
+				{Op: journalOpAdd, Tier: "gcs", ActionID: "a2", OutputID: "o2", Size: 2, Path: "/c/o2"},
+			},
+		},
+		{
+			name: "before tiers",
+			in: `{"op":"add","a":"a1","o":"o1","n":1,"p":"/c/o1"}
+`,
+			want: []journalEntry{
+				{Op: journalOpAdd, ActionID: "a1", OutputID: "o1", Size: 1, Path: "/c/o1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "uploads-1.jsonl")
+			if err := os.WriteFile(path, []byte(tt.in), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readJournal(path)
+			if err != nil {
+				t.Fatalf("readJournal: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
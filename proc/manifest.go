@@ -0,0 +1,172 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
+	"github.com/adambenhassen/gocacheprog/utils"
+)
+
+// manifest records the actions a run used, hits and puts alike, so that the
+// next run with the same cache key can prefetch them from the remote tiers.
+type manifest struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+func (m *manifest) record(actionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ids == nil {
+		m.ids = map[string]struct{}{}
+	}
+	m.ids[actionID] = struct{}{}
+}
+
+// bytes returns the manifest as sorted hex action IDs, one per line.
+func (m *manifest) bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.ids))
+	for id := range m.ids {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.WriteString(id)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func readManifest(r io.Reader) ([]string, error) {
+	var ids []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		id := string(bytes.TrimSpace(sc.Bytes()))
+		if _, err := hex.DecodeString(id); err != nil || id == "" {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, sc.Err()
+}
+
+// manifestTier returns the first remote tier that keeps manifests.
+func (p *Process) manifestTier() (*tier, cachers.ManifestStore) {
+	for _, t := range p.tiers {
+		if ms, ok := cachers.Find[cachers.ManifestStore](t.Cache); ok {
+			return t, ms
+		}
+	}
+	return nil, nil
+}
+
+// prefetch downloads the actions in the manifest of the first tier that keeps
+// one, and that aren't in the local cache yet, so that handleGet finds them
+// on disk. They are fetched through the whole chain.
+func (p *Process) prefetch(ctx context.Context) {
+	t, ms := p.manifestTier()
+	if t == nil || p.prefetchWorkers <= 0 || !p.mode.reads() || !t.breaker.allow() {
+		return
+	}
+
+	mctx := ctx
+	if p.getTimeout > 0 {
+		var cancel context.CancelFunc
+		mctx, cancel = context.WithTimeout(ctx, p.getTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	rc, err := ms.GetManifest(mctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			t.breaker.done(ctx, err, 0)
+		}
+		if p.verbose {
+			log.Printf("prefetch: no manifest in %s: %v", t.Name, err)
+		}
+		return
+	}
+	ids, err := readManifest(rc)
+	rc.Close()
+	if err != nil {
+		log.Printf("prefetch: reading manifest: %v", err)
+	}
+
+	var g errgroup.Group
+	g.SetLimit(p.prefetchWorkers)
+	for _, id := range ids {
+		if ctx.Err() != nil || !t.breaker.allow() {
+			break
+		}
+		if _, err := p.local.GetAction(ctx, id); err == nil || p.negCached(id) {
+			continue
+		}
+
+		g.Go(func() error {
+			_, err := p.fetchShared(ctx, id)
+			switch {
+			case err == nil:
+				p.stats.Prefetched.Inc()
+				p.prefetched.Store(id, struct{}{})
+			case !errors.Is(err, errRemoteMiss) && !errors.Is(err, errRemoteUnavailable) && ctx.Err() == nil:
+				p.stats.PrefetchFailed.Inc()
+				log.Printf("prefetch %s: %v", id, err)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	if p.verbose {
+		log.Printf("prefetched %d of %d manifest entries, took: %s", p.stats.Prefetched.Load(), len(ids), utils.FormatDuration(time.Since(start)))
+	}
+}
+
+// saveManifest stores the actions this run used with every tier that keeps
+// manifests and is written to, within the close timeout, unless the tier is
+// given up on. Read-only runs leave the manifests alone.
+func (p *Process) saveManifest() {
+	if !p.mode.writes() {
+		return
+	}
+
+	ctx := context.Background()
+	if p.closeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.closeTimeout)
+		defer cancel()
+	}
+
+	b := p.manifest.bytes()
+	if len(b) == 0 {
+		return
+	}
+
+	for _, t := range p.tiers {
+		ms, ok := cachers.Find[cachers.ManifestStore](t.Cache)
+		if !ok || t.Write == WriteNever || !t.breaker.allow() {
+			continue
+		}
+		if err := ms.PutManifest(ctx, bytes.NewReader(b)); err != nil {
+			log.Printf("%s: saving manifest: %v", t.Name, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// negativeCache remembers the actions the remote didn't have, so that asking
+// for them again within the TTL is answered without a round trip. It is
+// persisted in the cache dir, per remote, so incremental builds benefit too.
+type negativeCache struct {
+	path string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	misses  map[string]int64 // actionID -> when the miss was seen, Unix nanos
+	forgets map[string]struct{}
+}
+
+func newNegativeCache(dir, remote string, ttl time.Duration) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(remote))
+	nc := &negativeCache{
+		path:    filepath.Join(dir, fmt.Sprintf("negcache-%x.json", sum[:8])),
+		ttl:     ttl,
+		forgets: map[string]struct{}{},
+	}
+	nc.misses = nc.load()
+	return nc
+}
+
+// has reports whether actionID is a recent remote miss.
+func (nc *negativeCache) has(actionID string) bool {
+	if nc == nil {
+		return false
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	seen, ok := nc.misses[actionID]
+	return ok && time.Since(time.Unix(0, seen)) < nc.ttl
+}
+
+// add records that the remote doesn't have actionID.
+func (nc *negativeCache) add(actionID string) {
+	if nc == nil {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	nc.misses[actionID] = time.Now().UnixNano()
+	delete(nc.forgets, actionID)
+}
+
+// forget drops actionID, which this process is about to put.
+func (nc *negativeCache) forget(actionID string) {
+	if nc == nil {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	delete(nc.misses, actionID)
+	nc.forgets[actionID] = struct{}{}
+}
+
+// load reads the unexpired misses from disk.
+func (nc *negativeCache) load() map[string]int64 {
+	misses := map[string]int64{}
+
+	b, err := os.ReadFile(nc.path)
+	if err != nil {
+		return misses
+	}
+	if err := json.Unmarshal(b, &misses); err != nil {
+		return map[string]int64{}
+	}
+
+	for actionID, seen := range misses {
+		if time.Since(time.Unix(0, seen)) >= nc.ttl {
+			delete(misses, actionID)
+		}
+	}
+	return misses
+}
+
+// save merges the misses of this run into what other processes may have
+// written since it started, and writes the result back.
+func (nc *negativeCache) save() error {
+	if nc == nil {
+		return nil
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	misses := nc.load()
+	for actionID := range nc.forgets {
+		delete(misses, actionID)
+	}
+	for actionID, seen := range nc.misses {
+		if seen > misses[actionID] && time.Since(time.Unix(0, seen)) < nc.ttl {
+			misses[actionID] = seen
+		}
+	}
+
+	b, err := json.Marshal(misses)
+	if err != nil {
+		return err
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(nc.path), filepath.Base(nc.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), nc.path)
+}
@@ -0,0 +1,418 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
+	"github.com/adambenhassen/gocacheprog/utils"
+)
+
+// packEntry is a line of a pack index: where the output of an action is in
+// the pack.
+type packEntry struct {
+	ActionID string `json:"a"`
+	OutputID string `json:"o"`
+	Offset   int64  `json:"off"`
+	Size     int64  `json:"n"`
+}
+
+type packRef struct {
+	pack string
+	packEntry
+}
+
+// packIndex maps the actions in the packs of a tier to where they are. It is
+// loaded in the background on startup; gets look actions up in what has been
+// loaded so far rather than wait for it.
+type packIndex struct {
+	store  cachers.PackStore
+	loaded chan struct{}
+
+	mu   sync.RWMutex
+	refs map[string]packRef
+}
+
+// lookup returns where actionID is packed, as far as the index knows yet.
+func (pi *packIndex) lookup(actionID string) (packRef, bool) {
+	if pi == nil {
+		return packRef{}, false
+	}
+
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+	ref, ok := pi.refs[actionID]
+	return ref, ok
+}
+
+// complete reports whether the index is loaded, so that an action it doesn't
+// know of really isn't packed.
+func (pi *packIndex) complete() bool {
+	if pi == nil {
+		return true
+	}
+	select {
+	case <-pi.loaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// add indexes the entries of the pack name. Names sort by when the pack was
+// made, and later packs win, whichever order they are added in.
+func (pi *packIndex) add(name string, entries []packEntry) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	for _, e := range entries {
+		if ref, ok := pi.refs[e.ActionID]; ok && ref.pack > name {
+			continue
+		}
+		pi.refs[e.ActionID] = packRef{pack: name, packEntry: e}
+	}
+}
+
+// packTime returns when the pack name was made, from its name.
+func packTime(name string) (time.Time, bool) {
+	if len(name) < len(packTimeFormat) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(packTimeFormat, name[:len(packTimeFormat)])
+	return t, err == nil
+}
+
+const packTimeFormat = "20060102T150405"
+
+// loadPacks reads the indexes of the packs of every tier that keeps them.
+// Indexes never change once put, so they are kept in the state dir rather
+// than downloaded on every run.
+func (p *Process) loadPacks(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range p.tiers {
+		if t.packs == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(t.packs.loaded)
+			if err := p.loadPackIndex(ctx, t); err != nil && ctx.Err() == nil {
+				log.Printf("%s: loading packs: %v", t.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// loadPackIndex reads the indexes of the packs of t made within the pack max
+// age. Older packs are left out, and deleted from t if it is written to,
+// along with the indexes kept of packs that are gone.
+func (p *Process) loadPackIndex(ctx context.Context, t *tier) error {
+	if !p.mode.reads() || !t.breaker.allow() {
+		return nil
+	}
+
+	lctx := ctx
+	if p.getTimeout > 0 {
+		var cancel context.CancelFunc
+		lctx, cancel = context.WithTimeout(ctx, p.getTimeout)
+		defer cancel()
+	}
+
+	listed, err := t.packs.store.ListPacks(lctx)
+	if err != nil {
+		return err
+	}
+
+	var names, expired []string
+	for _, name := range listed {
+		if made, ok := packTime(name); ok && p.packMaxAge > 0 && time.Since(made) > p.packMaxAge {
+			expired = append(expired, name)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	sum := sha256.Sum256([]byte(t.Name))
+	dir := filepath.Join(p.dir, "packs", fmt.Sprintf("%x", sum[:8]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	prunePackIndexes(dir, names)
+
+	var g errgroup.Group
+	g.SetLimit(max(p.prefetchWorkers, 1))
+	for _, name := range names {
+		g.Go(func() error {
+			entries, err := readPackIndex(lctx, t.packs.store, filepath.Join(dir, name+".idx"), name)
+			if err != nil {
+				log.Printf("%s: pack %s: %v", t.Name, name, err)
+				return nil
+			}
+			t.packs.add(name, entries)
+			return nil
+		})
+	}
+	g.Wait()
+
+	if p.verbose {
+		t.packs.mu.RLock()
+		log.Printf("%s: %d actions in %d packs", t.Name, len(t.packs.refs), len(names))
+		t.packs.mu.RUnlock()
+	}
+
+	if len(expired) > 0 && t.Write != WriteNever && p.mode.writes() {
+		p.deletePacks(lctx, t, expired)
+	}
+	return nil
+}
+
+// deletePacks deletes the packs names from t. Processes sharing t may be at
+// it too; packs already gone are not an error.
+func (p *Process) deletePacks(ctx context.Context, t *tier, names []string) {
+	var deleted int
+	for _, name := range names {
+		err := t.packs.store.DeletePack(ctx, name)
+		switch {
+		case errors.Is(err, errors.ErrUnsupported):
+			return
+		case err == nil, errors.Is(err, cachers.ErrNotFound):
+			deleted++
+		default:
+			log.Printf("%s: delete pack %s: %v", t.Name, name, err)
+		}
+	}
+	if p.verbose && deleted > 0 {
+		log.Printf("%s: deleted %d packs older than %s", t.Name, deleted, utils.FormatDuration(p.packMaxAge))
+	}
+}
+
+// prunePackIndexes removes the indexes kept in dir of packs other than names.
+func prunePackIndexes(dir string, names []string) {
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	for _, de := range dirents {
+		name, ok := strings.CutSuffix(de.Name(), ".idx")
+		if ok && !keep[name] {
+			os.Remove(filepath.Join(dir, de.Name()))
+		}
+	}
+}
+
+// readPackIndex reads the index of the pack name from the file it was kept
+// in, or downloads it there first.
+func readPackIndex(ctx context.Context, store cachers.PackStore, file, name string) ([]packEntry, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		rc, err := store.GetPackIndex(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		b, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file, b, 0644); err != nil {
+			log.Printf("keeping pack index: %v", err)
+		}
+	}
+
+	var entries []packEntry
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		var e packEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%w: index: %v", cachers.ErrCorrupt, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// packer collects the outputs too small to be uploaded on their own, and
+// uploads them in packs of about size bytes to every tier that keeps packs
+// and is written to, whatever its write policy. What hasn't been packed yet
+// is uploaded on close; unlike single uploads, it isn't journaled.
+type packer struct {
+	p     *Process
+	tiers []*tier
+	size  int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	pending []*cachers.Action
+	bytes   int64
+}
+
+func newPacker(p *Process, tiers []*tier, size int64) *packer {
+	pk := &packer{p: p, tiers: tiers, size: size}
+	pk.ctx, pk.cancel = context.WithCancel(context.Background())
+	return pk
+}
+
+// add queues the local entry a to be packed.
+func (pk *packer) add(a *cachers.Action) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.pending = append(pk.pending, a)
+	pk.bytes += a.Size
+	if pk.bytes >= pk.size {
+		pk.sealLocked()
+	}
+}
+
+// sealLocked uploads the pending outputs as a pack, in the background.
+func (pk *packer) sealLocked() {
+	if len(pk.pending) == 0 {
+		return
+	}
+	entries := pk.pending
+	pk.pending, pk.bytes = nil, 0
+
+	pk.wg.Add(1)
+	go func() {
+		defer pk.wg.Done()
+		if err := pk.upload(entries); err != nil {
+			pk.p.stats.UploadsFailed.Inc()
+			log.Printf("pack of %d outputs: %v", len(entries), err)
+		}
+	}()
+}
+
+// upload writes the outputs of entries that are still in the local cache
+// into a pack file, then puts it to every tier.
+func (pk *packer) upload(entries []*cachers.Action) error {
+	dir := filepath.Join(pk.p.dir, "packs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "pack-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var index bytes.Buffer
+	je := json.NewEncoder(&index)
+	var off int64
+	for _, a := range entries {
+		err := appendFile(f, a)
+		switch {
+		case errors.Is(err, errOutputMismatch):
+			pk.p.quarantine(a.ActionID, a.DiskPath)
+			continue
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return err
+		}
+		je.Encode(packEntry{ActionID: a.ActionID, OutputID: a.OutputID, Offset: off, Size: a.Size})
+		off += a.Size
+	}
+
+	if index.Len() == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(index.Bytes())
+	name := fmt.Sprintf("%s-%x", time.Now().UTC().Format(packTimeFormat), sum[:8])
+
+	for _, t := range pk.tiers {
+		if !t.breaker.allow() {
+			pk.p.stats.RemoteSkipped.Inc()
+			continue
+		}
+
+		ctx := pk.ctx
+		if pk.p.uploadTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, pk.p.uploadTimeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+		err := t.packs.store.PutPack(ctx, name, index.Bytes(), off, io.NewSectionReader(f, 0, off))
+		t.breaker.done(pk.ctx, err, 0)
+		if err != nil {
+			pk.p.stats.UploadsFailed.Inc()
+			log.Printf("%s: put pack %s: %v", t.Name, name, err)
+			continue
+		}
+		pk.p.stats.RemotePut.Since(start)
+		pk.p.stats.PacksUploaded.Inc()
+		pk.p.stats.BytesUploaded.Add(off)
+		if pk.p.verbose {
+			log.Printf("%s: put pack %s of %d outputs, %d bytes", t.Name, name, len(entries), off)
+		}
+	}
+	return nil
+}
+
+// appendFile appends the output of the local entry a to pack, if it matches
+// its ID.
+func appendFile(pack *os.File, a *cachers.Action) error {
+	f, err := os.Open(a.DiskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := verifyFile(f, a.OutputID, a.Size); err != nil {
+		return err
+	}
+	_, err = io.Copy(pack, f)
+	return err
+}
+
+// close uploads what is still pending and waits up to timeout for the packs
+// to go out before cancelling them. Zero waits indefinitely.
+func (pk *packer) close(timeout time.Duration) {
+	pk.mu.Lock()
+	pk.sealLocked()
+	pk.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pk.wg.Wait()
+		close(done)
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	select {
+	case <-done:
+	case <-deadline:
+		pk.cancel()
+		<-done
+	}
+}
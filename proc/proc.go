@@ -11,186 +11,679 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/adambenhassen/gocacheprog/cachers"
+	"github.com/adambenhassen/gocacheprog/stats"
+	"github.com/adambenhassen/gocacheprog/tracing"
 	"github.com/adambenhassen/gocacheprog/utils"
 	"github.com/adambenhassen/gocacheprog/wire"
 )
 
 type cacherCtxKey string
 
+// Span attributes.
+const (
+	attrActionID = attribute.Key("gocacheprog.action_id")
+	attrOutputID = attribute.Key("gocacheprog.output_id")
+	attrSize     = attribute.Key("gocacheprog.size")
+	attrHit      = attribute.Key("gocacheprog.hit") // local, remote or miss
+	attrTier     = attribute.Key("gocacheprog.tier")
+)
+
 var (
 	ErrUnknownCommand = errors.New("unknown command")
+	errRemoteMiss     = errors.New("remote miss")
 	requestIDKey      = cacherCtxKey("requestID")
+	deferredKey       = cacherCtxKey("deferred")
 )
 
+type handlerFunc func(ctx context.Context, req *wire.Request, res *wire.Response) error
+
+// Options configures a Process.
+type Options struct {
+	Verbose       bool
+	MinUploadSize int64
+
+	// Dir holds the state kept across runs, such as the upload journal.
+	// It defaults to the gocacheprog directory in the user cache dir.
+	Dir string
+
+	// StatsFile, if set, receives the run statistics as JSON on exit.
+	StatsFile string
+
+	// Stats, if set, collects the run statistics, for middleware that
+	// records into them too.
+	Stats *stats.Stats
+
+	// RemoteMode restricts the remote tiers to reads or writes. The zero
+	// value reads and writes.
+	RemoteMode RemoteMode
+
+	// NegativeCacheTTL is how long a miss in a remote tier is remembered.
+	// Zero disables the negative cache.
+	NegativeCacheTTL time.Duration
+
+	// PrefetchWorkers is how many entries of the remote manifest are
+	// downloaded concurrently on startup. Zero disables prefetching.
+	PrefetchWorkers int
+
+	// CloseTimeout bounds how long pending uploads are flushed on close,
+	// end of input or a signal before they are cancelled. Zero waits for
+	// them indefinitely.
+	CloseTimeout time.Duration
+
+	// PackSize is how many bytes of outputs under MinUploadSize are
+	// gathered into a pack before it is uploaded to the tiers that keep
+	// packs. Zero doesn't upload small outputs at all.
+	PackSize int64
+
+	// PackMaxAge is how long packs are read from after they were made.
+	// Older ones are deleted from the tiers written to, so that the packs
+	// to list and index on startup don't pile up. Zero keeps them forever.
+	PackMaxAge time.Duration
+
+	// GetTimeout bounds each get from a remote tier, download included.
+	// Zero waits for the tier indefinitely.
+	GetTimeout time.Duration
+
+	Breaker BreakerOptions
+	Upload  UploadOptions
+}
+
 type Process struct {
-	local         cachers.Cache
-	remote        cachers.Cache
-	gwg           sync.WaitGroup
-	verbose       bool
-	dir           string
-	minUploadSize int64
-
-	gets        int64
-	hits_local  int64
-	hits_remote int64
-
-	miss         int64
-	puts         int64
-	puts_errored int64
-	puts_ignored int64
+	local           cachers.Cache
+	tiers           []*tier // below local, in the order they are consulted
+	mode            RemoteMode
+	journal         *journal
+	packer          *packer
+	manifest        manifest
+	prefetched      sync.Map // actionIDs downloaded by prefetch
+	fetches         singleflight.Group
+	verbose         bool
+	dir             string
+	minUploadSize   int64
+	packMaxAge      time.Duration
+	closeTimeout    time.Duration
+	getTimeout      time.Duration
+	uploadTimeout   time.Duration
+	prefetchWorkers int
+	handlers        map[wire.Cmd]handlerFunc
+	stats           *stats.Stats
+	statsFile       string
 }
 
-func NewCacheProc(local, remote cachers.Cache, verbose bool, minUploadSize int64) *Process {
-	d, err := os.UserCacheDir()
+// NewCacheProc returns a Process serving from tiers, fastest first. The first
+// tier has to be the local disk cache, written through.
+func NewCacheProc(tiers []Tier, opts Options) (*Process, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("no cache tiers")
+	}
+	mode, err := ParseRemoteMode(string(opts.RemoteMode))
+	if err != nil {
+		return nil, err
+	}
+	if tiers[0].Write != WriteThrough {
+		return nil, fmt.Errorf("tier %s: the local tier has to be written through", tiers[0].Name)
+	}
+
+	d := opts.Dir
+	if d == "" {
+		ucd, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no directory for the cache state: %w", err)
+		}
+		d = filepath.Join(ucd, "gocacheprog")
+	}
+
+	j, err := openJournal(d)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("upload journal disabled: %v", err)
+	}
+
+	st := opts.Stats
+	if st == nil {
+		st = stats.New()
+	}
+	p := &Process{
+		local:           tiers[0].Cache,
+		mode:            mode,
+		journal:         j,
+		stats:           st,
+		statsFile:       opts.StatsFile,
+		verbose:         opts.Verbose,
+		dir:             d,
+		minUploadSize:   opts.MinUploadSize,
+		packMaxAge:      opts.PackMaxAge,
+		closeTimeout:    opts.CloseTimeout,
+		getTimeout:      opts.GetTimeout,
+		uploadTimeout:   opts.Upload.Timeout,
+		prefetchWorkers: opts.PrefetchWorkers,
+	}
+	for _, tt := range tiers[1:] {
+		if _, err := ParseWritePolicy(string(tt.Write)); err != nil {
+			return nil, fmt.Errorf("tier %s: %w", tt.Name, err)
+		}
+		if p.findTier(tt.Name) != nil {
+			return nil, fmt.Errorf("tier %s: listed twice", tt.Name)
+		}
+
+		t := &tier{Tier: tt, negcache: newNegativeCache(d, tt.Name, opts.NegativeCacheTTL)}
+		t.breaker = newBreaker(tt.Name, opts.Breaker, opts.GetTimeout, t.probe, st, opts.Verbose)
+		if tt.Write == WriteBehind {
+			t.uploads = newUploader(tt.Name, tt.Cache, j, t.breaker, st, opts.Upload, p.quarantine)
+		}
+		if ps, ok := cachers.Find[cachers.PackStore](tt.Cache); ok {
+			t.packs = &packIndex{store: ps, loaded: make(chan struct{}), refs: map[string]packRef{}}
+		}
+		p.tiers = append(p.tiers, t)
+	}
+
+	var packTiers []*tier
+	for _, t := range p.tiers {
+		if t.packs != nil && t.Write != WriteNever {
+			packTiers = append(packTiers, t)
+		}
+	}
+	if opts.PackSize > 0 && len(packTiers) > 0 && mode.writes() {
+		p.packer = newPacker(p, packTiers, opts.PackSize)
 	}
-	return &Process{
-		local:         local,
-		remote:        remote,
-		verbose:       verbose,
-		dir:           d,
-		minUploadSize: minUploadSize,
+	p.handlers = map[wire.Cmd]handlerFunc{
+		wire.CmdGet:   p.handleGet,
+		wire.CmdPut:   p.handlePut,
+		wire.CmdClose: p.handleClose,
+	}
+	return p, nil
+}
+
+// knownCommands lists the commands advertised to cmd/go on startup.
+func (p *Process) knownCommands() []wire.Cmd {
+	cmds := make([]wire.Cmd, 0, len(p.handlers))
+	for cmd := range p.handlers {
+		cmds = append(cmds, cmd)
 	}
+	slices.Sort(cmds)
+	return cmds
 }
 
+// Run serves requests from cmd/go on stdin until close, end of input or ctx
+// is cancelled, then flushes pending uploads within the close timeout.
 func (p *Process) Run(ctx context.Context) error {
 	var wmu sync.Mutex
 
 	br := bufio.NewReader(os.Stdin)
-	jd := json.NewDecoder(br)
 
 	bw := bufio.NewWriter(os.Stdout)
 	je := json.NewEncoder(bw)
 
-	caps := []wire.Cmd{"get", "put", "close"}
-	if err := je.Encode(&wire.Response{KnownCommands: caps}); err != nil {
+	if err := je.Encode(&wire.Response{KnownCommands: p.knownCommands()}); err != nil {
 		return err
 	}
 	if err := bw.Flush(); err != nil {
 		return err
 	}
 
-	wg, ctx := errgroup.WithContext(ctx)
+	pctx, stopPrefetch := context.WithCancel(ctx)
+	prefetched := make(chan struct{})
+	go func() {
+		defer close(prefetched)
+		p.loadPacks(pctx)
+		p.prefetch(pctx)
+	}()
+
+	// Uploads left by earlier runs are resumed alongside serving, and have
+	// to be queued before the uploads are flushed and the journal closed.
+	var resuming sync.WaitGroup
+
+	wg, gctx := errgroup.WithContext(ctx)
 	defer func() {
 		wg.Wait()
-		p.gwg.Wait()
-		log.Printf("gets %v, hits_local: %v, hits_remote: %v, misses_remote: %v, puts: %v, puts_errored %v, puts_ignored %v\n",
-			p.gets, p.hits_local, p.hits_remote, p.miss, p.puts, p.puts_errored, p.puts_ignored)
+		stopPrefetch()
+		<-prefetched
+		resuming.Wait()
+		p.saveManifest()
+		p.flush(p.closeTimeout)
+		for _, t := range p.tiers {
+			t.breaker.close()
+			if err := t.negcache.save(); err != nil {
+				log.Printf("%s: negative cache: %v", t.Name, err)
+			}
+		}
+		p.report()
+	}()
+
+	// handle serves req. If deferred is set, handlers may leave part of the
+	// work to it, to be run before replying.
+	handle := func(req *wire.Request, deferred *func()) *wire.Response {
+		res := &wire.Response{ID: req.ID}
+
+		ctx := context.WithValue(gctx, requestIDKey, req)
+		if deferred != nil {
+			ctx = context.WithValue(ctx, deferredKey, deferred)
+		}
+		ctx, span := tracing.Tracer().Start(ctx, "gocacheprog."+string(req.Command))
+		if err := p.handleRequest(ctx, req, res); err != nil {
+			res.Err = err.Error()
+			log.Println(err.Error())
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		return res
+	}
+
+	reply := func(res *wire.Response) {
+		wmu.Lock()
+		defer wmu.Unlock()
+
+		je.Encode(res)
+		bw.Flush()
+	}
+
+	resuming.Add(1)
+	go func() {
+		defer resuming.Done()
+		p.resumeUploads()
 	}()
 
+	done := make(chan error, 1)
+	go func() {
+		done <- p.readRequests(br, wg, handle, reply)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("can't read requests any further, shutting down: %v", err)
+		}
+		return err
+	case <-ctx.Done():
+		log.Println("interrupted, flushing pending uploads")
+		return nil
+	}
+}
+
+// readRequests reads requests from br, handles them and replies until close
+// or end of input. Requests that can't be decoded are answered with an error
+// as long as the next request can still be found; otherwise it returns the
+// error.
+func (p *Process) readRequests(br *bufio.Reader, wg *errgroup.Group, handle func(*wire.Request, *func()) *wire.Response, reply func(*wire.Response)) error {
+	serve := func(req *wire.Request) {
+		reply(handle(req, nil))
+	}
+
 	for {
-		var req wire.Request
-		if err := jd.Decode(&req); err != nil {
+		req, err := readRequest(br)
+		var rerr *requestError
+		if errors.As(err, &rerr) {
+			reply(p.badRequest(rerr.id, rerr.err))
+
+			// Skip the body if it was a put.
+			if body, err := newBodyReader(br); err == nil {
+				body.Drain()
+				if !body.Resynced() {
+					return fmt.Errorf("request %d: skipping body: %w", rerr.id, io.ErrUnexpectedEOF)
+				}
+			}
+			continue
+		}
+		if err != nil {
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
 			return err
 		}
 
-		if req.Command != wire.CmdPut && req.Command != wire.CmdGet && req.Command != wire.CmdClose {
+		if _, ok := p.handlers[req.Command]; !ok {
 			continue
 		}
 
+		if req.Command == wire.CmdClose {
+			// Answer everything in flight, reply to close and return; Run
+			// flushes pending uploads before we exit.
+			wg.Wait()
+			serve(req)
+			return nil
+		}
+
 		if req.Command == wire.CmdPut && req.BodySize > 0 {
-			var bodyb []byte
-			if err := jd.Decode(&bodyb); err != nil {
-				log.Fatal(err)
+			body, err := newBodyReader(br)
+			if errors.Is(err, errNoBody) {
+				reply(p.badRequest(req.ID, err))
+				continue
 			}
-
-			if int64(len(bodyb)) != req.BodySize {
-				log.Fatalf("only got %d bytes of declared %d", len(bodyb), req.BodySize)
+			if err != nil {
+				return fmt.Errorf("put %d: %w", req.ID, err)
 			}
-
-			req.Body = bytes.NewReader(bodyb)
+			req.Body = body
+
+			// The body has to be consumed before the next request can be
+			// read, so puts with a body are written to the local cache inline.
+			// The other tiers are written, and the put answered, once the body
+			// turned out to be whole.
+			var deferred func()
+			res := handle(req, &deferred)
+
+			n, err := body.Drain()
+			if !body.Resynced() {
+				return fmt.Errorf("put %d: reading body: %w", req.ID, err)
+			}
+			if err == nil && n != req.BodySize {
+				err = fmt.Errorf("got %d bytes of declared %d", n, req.BodySize)
+			}
+			if err != nil {
+				reply(p.badRequest(req.ID, fmt.Errorf("put body: %w", err)))
+				continue
+			}
+			wg.Go(func() error {
+				if deferred != nil {
+					deferred()
+				}
+				reply(res)
+				return nil
+			})
+			continue
 		}
 
 		wg.Go(func() error {
-			res := &wire.Response{ID: req.ID}
+			serve(req)
+			return nil
+		})
+	}
+}
 
-			ctx := context.WithValue(ctx, requestIDKey, &req)
-			if err := p.handleRequest(ctx, &req, res); err != nil {
-				res.Err = err.Error()
-				log.Println(err.Error())
-			}
+// flush waits up to timeout for pending uploads to every tier, then cancels
+// whatever is still queued or running and reports how many uploads were
+// abandoned.
+func (p *Process) flush(timeout time.Duration) {
+	var wg sync.WaitGroup
+	if p.packer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.packer.close(timeout)
+		}()
+	}
+	for _, t := range p.tiers {
+		if t.uploads == nil {
+			continue
+		}
+		if n := t.uploads.pending(); n > 0 && p.verbose {
+			log.Printf("%s: flushing %d pending uploads", t.Name, n)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.uploads.close(timeout)
+		}()
+	}
+	wg.Wait()
+
+	// The throughput is that of the uploads behind, from the first to start
+	// to the last to finish across tiers.
+	var start, end time.Time
+	var uploaded int64
+	for _, t := range p.tiers {
+		if t.uploads == nil {
+			continue
+		}
+		s, e, n := t.uploads.window()
+		if s.IsZero() {
+			continue
+		}
+		if start.IsZero() || s.Before(start) {
+			start = s
+		}
+		if e.After(end) {
+			end = e
+		}
+		uploaded += n
+	}
+	if span := end.Sub(start); !start.IsZero() && span > 0 {
+		p.stats.UploadThroughput = int64(float64(uploaded) / span.Seconds())
+	}
 
-			wmu.Lock()
-			defer wmu.Unlock()
+	if abandoned := p.stats.UploadsAbandoned.Load(); abandoned > 0 {
+		log.Printf("abandoned %d pending uploads after %s", abandoned, utils.FormatDuration(timeout))
+	}
+	if n := p.journal.close(); n > 0 {
+		log.Printf("%d uploads left in the journal for the next run", n)
+	}
+}
 
-			je.Encode(res)
-			bw.Flush()
+// Flush resumes the uploads journaled by earlier runs and waits for them
+// within the close timeout, without serving cmd/go.
+func (p *Process) Flush() {
+	p.resumeUploads()
+	p.flush(p.closeTimeout)
+	for _, t := range p.tiers {
+		t.breaker.close()
+	}
+	p.report()
+}
 
-			return nil
-		})
+// report logs the run statistics and writes them to the stats file.
+func (p *Process) report() {
+	st := p.stats
+	st.End = time.Now()
+
+	log.Printf("gets %v, hits_local: %v, hits_remote: %v, misses_remote: %v (cached %v), puts: %v, puts_errored %v, puts_ignored %v, puts_suppressed %v, uploads_abandoned %v\n",
+		st.Gets.Load(), st.HitsLocal.Load(), st.HitsRemote.Load(), st.Misses.Load(), st.MissesCached.Load(), st.Puts.Load(), st.UploadsFailed.Load(), st.PutsIgnored.Load(), st.PutsSuppressed.Load(), st.UploadsAbandoned.Load())
+	log.Printf("uploads: %v (%s, %s/s), upload_queue_max: %v (%s), uploads_deduped: %v, uploads_coalesced: %v, uploads_dropped: %v, downloaded: %s, gets_coalesced: %v\n",
+		st.Uploads.Load(), utils.FormatBytes(st.BytesUploaded.Load()), utils.FormatBytes(st.UploadThroughput),
+		st.UploadQueueMaxDepth.Load(), utils.FormatBytes(st.UploadQueueMaxBytes.Load()),
+		st.UploadsDeduped.Load(), st.UploadsCoalesced.Load(), st.UploadsDropped.Load(), utils.FormatBytes(st.BytesDownloaded.Load()), st.GetsCoalesced.Load())
+	if st.BreakerOpened.Load() > 0 || st.RemoteTimeouts.Load() > 0 {
+		log.Printf("remote_timeouts: %v, breaker_opened: %v, remote_skipped: %v\n",
+			st.RemoteTimeouts.Load(), st.BreakerOpened.Load(), st.RemoteSkipped.Load())
+	}
+	if len(p.tiers) > 1 {
+		log.Printf("hits_by_tier: %v\n", st.HitsByTier.Snapshot())
+	}
+	if byKey := st.HitsByKey.Snapshot(); len(byKey) > 0 {
+		log.Printf("hits_by_key: %v\n", byKey)
+	}
+
+	if p.statsFile != "" {
+		if err := st.WriteFile(p.statsFile); err != nil {
+			log.Printf("writing stats: %v", err)
+		}
+	}
+}
+
+// resumeUploads queues the uploads earlier runs left pending, as long as
+// their outputs are still in the local disk cache. Uploads journaled before
+// tiers existed go to the first write-behind tier; uploads to tiers that are
+// no longer written behind stay in the journal, as does everything in
+// read-only mode.
+func (p *Process) resumeUploads() {
+	if !p.mode.writes() {
+		return
+	}
+
+	entries, err := p.journal.claim()
+	if err != nil {
+		log.Printf("journal: %v", err)
+	}
+
+	var legacy *tier
+	for _, t := range p.tiers {
+		if t.uploads != nil {
+			legacy = t
+			break
+		}
 	}
+
+	var resumed int
+	for _, e := range entries {
+		fi, err := os.Stat(e.Path)
+		if err != nil || fi.Size() != e.Size {
+			p.journal.done(e.Tier, e.ActionID, e.OutputID)
+			continue
+		}
+
+		t := legacy
+		if e.Tier != "" {
+			t = p.findTier(e.Tier)
+		}
+		if t == nil || t.uploads == nil {
+			continue
+		}
+		if e.Tier == "" {
+			p.journal.done(e.Tier, e.ActionID, e.OutputID)
+		}
+		t.uploads.enqueue(context.Background(), e.ActionID, e.OutputID, e.Size, e.Path)
+		resumed++
+	}
+
+	if resumed > 0 {
+		log.Printf("resuming %d uploads from an earlier run", resumed)
+	}
+}
+
+// requestError is a request line that couldn't be decoded, but whose ID
+// could still be made out to answer it.
+type requestError struct {
+	id  int64
+	err error
+}
+
+func (e *requestError) Error() string { return fmt.Sprintf("request %d: %v", e.id, e.err) }
+func (e *requestError) Unwrap() error { return e.err }
+
+// readRequest reads the next JSON request line from br.
+func readRequest(br *bufio.Reader) (*wire.Request, error) {
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var req wire.Request
+		if err := json.Unmarshal(line, &req); err != nil {
+			var id struct{ ID int64 }
+			if json.Unmarshal(line, &id) == nil && id.ID != 0 {
+				return nil, &requestError{id: id.ID, err: fmt.Errorf("malformed request: %w", err)}
+			}
+			line = bytes.TrimSpace(line)
+			return nil, fmt.Errorf("malformed request %q: %w", line[:min(len(line), 100)], err)
+		}
+		return &req, nil
+	}
+}
+
+// badRequest answers a request that couldn't be served as sent.
+func (p *Process) badRequest(id int64, err error) *wire.Response {
+	p.stats.BadRequests.Inc()
+	log.Printf("request %d: %v", id, err)
+	return &wire.Response{ID: id, Err: err.Error()}
 }
 
 func (p *Process) handleRequest(ctx context.Context, req *wire.Request, res *wire.Response) error {
-	switch req.Command {
-	default:
+	h, ok := p.handlers[req.Command]
+	if !ok {
 		return ErrUnknownCommand
-	case "close":
-		return nil
-	case "get":
-		err := p.handleGet(ctx, req, res)
-		atomic.AddInt64(&p.gets, 1)
-		if res.Miss {
-			atomic.AddInt64(&p.miss, 1)
-		}
-		return err
-	case "put":
-		return p.handlePut(ctx, req, res)
 	}
+	return h(ctx, req, res)
+}
+
+func (p *Process) handleClose(_ context.Context, _ *wire.Request, _ *wire.Response) error {
+	return nil
 }
 
 func (p *Process) handleGet(ctx context.Context, req *wire.Request, res *wire.Response) (retErr error) {
-	var outputPath string
+	p.stats.Gets.Inc()
+	defer func() {
+		if res.Miss {
+			p.stats.Misses.Inc()
+		}
+	}()
+
 	actionID := fmt.Sprintf("%x", req.ActionID)
 	start := time.Now()
 
-	_, outputPath, _, _, err := p.local.Get(ctx, actionID)
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attrActionID.String(actionID))
+	defer func() {
+		switch {
+		case res.Miss:
+			span.SetAttributes(attrHit.String("miss"))
+		case res.DiskPath != "":
+			span.SetAttributes(attrOutputID.String(fmt.Sprintf("%x", res.OutputID)), attrSize.Int64(res.Size))
+		}
+	}()
+
+	lctx, lspan := tracing.Tracer().Start(ctx, "local.get")
+	a, err := p.local.GetAction(lctx, actionID)
+	lspan.End()
+	p.stats.LocalGet.Since(start)
 	if err != nil {
-		outputID, _, size, reader, err := p.remote.Get(ctx, actionID)
-		if err != nil {
+		if !p.mode.reads() {
 			res.Miss = true
-			// log.Printf("<- GET %s miss, took: %s\n", actionID, utils.FormatDuration(time.Since(start)))
 			return nil
 		}
-
-		if outputID == "" {
+		if p.negCached(actionID) {
+			p.stats.MissesCached.Inc()
 			res.Miss = true
 			return nil
 		}
 
-		res.OutputID, err = hex.DecodeString(outputID)
+		start := time.Now()
+		defer p.stats.RemoteGet.Since(start)
+
+		ctx, rspan := tracing.Tracer().Start(ctx, "remote.get")
+		defer rspan.End()
+
+		f, err := p.fetchShared(ctx, actionID)
 		if err != nil {
 			res.Miss = true
-			return fmt.Errorf("invalid OutputID: %w", err)
+			switch {
+			case errors.Is(err, errRemoteMiss):
+				return nil
+			case errors.Is(err, errRemoteUnavailable):
+				p.stats.RemoteSkipped.Inc()
+				rspan.SetAttributes(attribute.Bool("gocacheprog.skipped", true))
+				return nil
+			}
+			return err
 		}
-
-		outputPath, err = p.local.Put(ctx, actionID, outputID, size, reader)
+		a = f.Action
+		res.OutputID, _ = hex.DecodeString(a.OutputID)
+
+		p.stats.HitsRemote.Inc()
+		p.manifest.record(actionID)
+		span.SetAttributes(attrHit.String("remote"))
+		if f.tier != "" {
+			span.SetAttributes(attrTier.String(f.tier))
+			rspan.SetAttributes(attrTier.String(f.tier))
+		}
+	} else {
+		res.OutputID, err = hex.DecodeString(a.OutputID)
 		if err != nil {
 			res.Miss = true
-			return fmt.Errorf("unable to save to file: %w", err)
+			return fmt.Errorf("invalid OutputID: %w", err)
 		}
-
-		if p.verbose {
-			log.Printf("<- GET %s took: %s\n", actionID, utils.FormatDuration(time.Since(start)))
+		p.stats.HitsLocal.Inc()
+		p.manifest.record(actionID)
+		if _, ok := p.prefetched.LoadAndDelete(actionID); ok {
+			p.stats.HitsPrefetched.Inc()
 		}
-
-		atomic.AddInt64(&p.hits_remote, 1)
-	} else {
-		atomic.AddInt64(&p.hits_local, 1)
+		span.SetAttributes(attrHit.String("local"))
 	}
 
-	fi, err := os.Stat(outputPath)
+	fi, err := os.Stat(a.DiskPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			res.Miss = true
@@ -205,56 +698,250 @@ func (p *Process) handleGet(ctx context.Context, req *wire.Request, res *wire.Re
 	}
 
 	res.Size = fi.Size()
-	res.TimeNanos = fi.ModTime().UnixNano()
-	res.DiskPath = outputPath
+	mtime := fi.ModTime()
+	res.Time = &mtime
+	res.DiskPath = a.DiskPath
 
 	return nil
 }
 
-func (p *Process) handlePut(_ context.Context, req *wire.Request, res *wire.Response) (retErr error) {
-	ctx := context.Background()
+// negCached reports whether every remote tier recently missed actionID.
+func (p *Process) negCached(actionID string) bool {
+	for _, t := range p.tiers {
+		if !t.negcache.has(actionID) {
+			return false
+		}
+	}
+	return len(p.tiers) > 0
+}
 
-	actionID, objectID := fmt.Sprintf("%x", req.ActionID), fmt.Sprintf("%x", req.ObjectID)
+// fetched is the local entry of an action downloaded from a remote tier.
+type fetched struct {
+	*cachers.Action
+	tier string // empty if another process sharing the local cache got it
+}
+
+// fetchShared is fetchTiers, joining a fetch of the same action that is
+// already in flight rather than downloading it again.
+func (p *Process) fetchShared(ctx context.Context, actionID string) (*fetched, error) {
+	var leader bool
+	v, err, _ := p.fetches.Do(actionID, func() (any, error) {
+		leader = true
+		return p.fetchLocked(ctx, actionID)
+	})
+	if !leader {
+		p.stats.GetsCoalesced.Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*fetched), nil
+}
+
+// fetchLocked is fetchTiers, once no other process sharing the local cache is
+// fetching actionID. If one was, what it fetched is used instead.
+func (p *Process) fetchLocked(ctx context.Context, actionID string) (*fetched, error) {
+	l, ok := cachers.Find[cachers.Locker](p.local)
+	if !ok {
+		return p.fetchTiers(ctx, actionID)
+	}
+
+	unlock, err := l.LockAction(ctx, actionID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if a, err := p.local.GetAction(ctx, actionID); err == nil {
+		p.stats.GetsCoalesced.Inc()
+		return &fetched{Action: a}, nil
+	}
+	return p.fetchTiers(ctx, actionID)
+}
+
+// fetchTiers looks actionID up in the remote tiers in order, downloads it
+// from the first that has it into the local cache, and backfills the tiers
+// above that one. It returns errRemoteMiss if no tier has it, and
+// errRemoteUnavailable if the tiers that might have it were all skipped. The
+// first failure of a tier is returned only if no other tier has it either.
+func (p *Process) fetchTiers(ctx context.Context, actionID string) (*fetched, error) {
+	var firstErr error
+	var skipped, missed bool
+	for i, t := range p.tiers {
+		if t.negcache.has(actionID) {
+			continue
+		}
+
+		la, err := p.fetchRemote(ctx, t, actionID)
+		switch {
+		case err == nil:
+			p.stats.HitsByTier.Inc(t.Name)
+			p.writeTiers(ctx, p.tiers[:i], la)
+			return &fetched{Action: la, tier: t.Name}, nil
+		case errors.Is(err, errRemoteMiss):
+			missed = true
+		case errors.Is(err, errRemoteUnavailable):
+			skipped = true
+		default:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", t.Name, err)
+			}
+		}
+	}
+
+	switch {
+	case firstErr != nil:
+		return nil, firstErr
+	case skipped && !missed:
+		return nil, errRemoteUnavailable
+	}
+	return nil, errRemoteMiss
+}
+
+// fetchRemote downloads the output of actionID from t into the local cache
+// and returns the local entry. It returns errRemoteMiss if t doesn't have it,
+// and errRemoteUnavailable if its breaker is open.
+func (p *Process) fetchRemote(ctx context.Context, t *tier, actionID string) (*cachers.Action, error) {
+	if !t.breaker.allow() {
+		return nil, errRemoteUnavailable
+	}
+
+	tctx := ctx
+	if p.getTimeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(ctx, p.getTimeout)
+		defer cancel()
+	}
+
+	ref, packed := t.packs.lookup(actionID)
+
+	start := time.Now()
+	var ra *cachers.Action
+	var rc io.ReadCloser
+	var err error
+	if packed {
+		ra = &cachers.Action{ActionID: actionID, OutputID: ref.OutputID, Size: ref.Size, Source: t.packs.store.PackSource(ref.pack)}
+		rc, err = t.packs.store.GetPackRange(tctx, ref.pack, ref.Offset, ref.Size)
+	}
+	if !packed || errors.Is(err, cachers.ErrNotFound) {
+		// The action may be stored on its own, even if its pack is gone.
+		packed = false
+		ra, rc, err = openOutput(tctx, t.Cache, actionID)
+	}
+	switch {
+	case errors.Is(err, cachers.ErrNotFound):
+		// Only a missing action is remembered: a missing output is fixed
+		// by the next put of the action. Until the pack index is loaded,
+		// the action may be in a pack it doesn't know of yet.
+		if ra == nil && t.packs.complete() {
+			t.negcache.add(actionID)
+		}
+		t.breaker.done(ctx, nil, time.Since(start))
+		return nil, errRemoteMiss
+	case errors.Is(err, cachers.ErrCorrupt):
+		t.breaker.done(ctx, nil, time.Since(start))
+		log.Printf("%s: %s: %v", t.Name, actionID, err)
+		return nil, errRemoteMiss
+	case err != nil:
+		t.breaker.done(ctx, err, time.Since(start))
+		return nil, err
+	}
+	defer rc.Close()
+
+	body := newVerifier(rc, ra.OutputID, ra.Size)
+	if ra.Size == 0 {
+		// The local cache doesn't read empty bodies.
+		err = body.verify()
+	}
+	var la *cachers.Action
+	if err == nil {
+		la, err = p.local.Put(tctx, actionID, ra.OutputID, ra.Size, body)
+	}
+	if errors.Is(err, errOutputMismatch) {
+		p.stats.RemoteCorrupt.Inc()
+		t.breaker.done(ctx, nil, time.Since(start))
+		log.Printf("%s: %s: %v", t.Name, actionID, err)
+		return nil, errRemoteMiss
+	}
+	if err != nil {
+		if tctx.Err() != nil {
+			t.breaker.done(ctx, tctx.Err(), time.Since(start))
+		}
+		return nil, fmt.Errorf("unable to save to file: %w", err)
+	}
+	t.breaker.done(ctx, nil, time.Since(start))
+
+	p.stats.BytesDownloaded.Add(ra.Size)
+	if packed {
+		p.stats.HitsPacked.Inc()
+	}
+	if ra.Source != "" {
+		p.stats.HitsByKey.Inc(ra.Source)
+	}
+	return la, nil
+}
+
+// openOutput looks actionID up in c and opens its output. The action is
+// returned as long as it was found.
+func openOutput(ctx context.Context, c cachers.Cache, actionID string) (*cachers.Action, io.ReadCloser, error) {
+	a, err := c.GetAction(ctx, actionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := hex.DecodeString(a.OutputID); err != nil {
+		return a, nil, fmt.Errorf("%w: invalid OutputID: %v", cachers.ErrCorrupt, err)
+	}
+	rc, err := c.GetOutput(ctx, a)
+	return a, rc, err
+}
+
+func (p *Process) handlePut(rctx context.Context, req *wire.Request, res *wire.Response) (retErr error) {
+	span := trace.SpanFromContext(rctx)
+
+	// Don't let the request context cut the write to the local cache short.
+	ctx := trace.ContextWithSpan(context.Background(), span)
+
+	actionID, objectID := fmt.Sprintf("%x", req.ActionID), fmt.Sprintf("%x", req.Output())
+	span.SetAttributes(attrActionID.String(actionID), attrOutputID.String(objectID), attrSize.Int64(req.BodySize))
 	defer func() {
 		if retErr != nil {
 			log.Printf("put(action %s, obj %s, %v bytes): %v", actionID, objectID, req.BodySize, retErr)
 		}
 	}()
 
-	var body io.Reader
-	var copyBuf bytes.Buffer
-
-	if req.Body == nil {
+	body := req.Body
+	if body == nil {
 		body = bytes.NewReader(nil)
-	} else {
-		body = io.TeeReader(req.Body, &copyBuf)
 	}
 
-	diskPath, err := p.local.Put(ctx, actionID, objectID, req.BodySize, body)
+	lctx, lspan := tracing.Tracer().Start(ctx, "local.put")
+	la, err := p.local.Put(lctx, actionID, objectID, req.BodySize, body)
+	lspan.End()
 	if err != nil {
 		return fmt.Errorf("unable to save to file: %w", err)
 	}
-	res.DiskPath = diskPath
+	p.manifest.record(actionID)
+	res.DiskPath = la.DiskPath
 	res.Size = req.BodySize
 
-	start := time.Now()
-	atomic.AddInt64(&p.puts, 1)
-	if req.BodySize >= p.minUploadSize { // 15kb
-		p.gwg.Add(1)
+	p.stats.Puts.Inc()
+	switch {
+	case req.BodySize < p.minUploadSize && p.packer == nil: // 15kb
+		p.stats.PutsIgnored.Inc()
+	case !p.mode.writes():
+		p.stats.PutsSuppressed.Inc()
+	case req.BodySize < p.minUploadSize:
+		p.packer.add(la)
+		p.stats.PutsPacked.Inc()
+	}
 
-		go func() {
-			defer p.gwg.Done()
-			_, err = p.remote.Put(ctx, actionID, objectID, req.BodySize, &copyBuf)
-			if err != nil {
-				atomic.AddInt64(&p.puts_errored, 1)
-				log.Print(err)
-			} else if p.verbose {
-				log.Printf("-> PUT %s took: %s, size: %v\n", actionID, utils.FormatDuration(time.Since(start)), req.BodySize)
-			}
-		}()
-	} else {
-		atomic.AddInt64(&p.puts_ignored, 1)
+	// Writing through to a remote tier can take long enough to hold up
+	// reading the next requests, so it is left to the caller if it can.
+	if deferred, ok := rctx.Value(deferredKey).(*func()); ok {
+		*deferred = func() { p.writeTiers(ctx, p.tiers, la) }
+		return nil
 	}
+	p.writeTiers(ctx, p.tiers, la)
 
 	return nil
 }
@@ -0,0 +1,181 @@
+package proc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
+	"github.com/adambenhassen/gocacheprog/tracing"
+)
+
+// WritePolicy decides how puts, and hits from tiers further down, reach a
+// tier.
+type WritePolicy string
+
+const (
+	// WriteThrough writes to the tier before the request is answered.
+	WriteThrough WritePolicy = "through"
+
+	// WriteBehind queues the write for the background uploader.
+	WriteBehind WritePolicy = "behind"
+
+	// WriteNever only reads from the tier.
+	WriteNever WritePolicy = "never"
+)
+
+func ParseWritePolicy(s string) (WritePolicy, error) {
+	switch p := WritePolicy(s); p {
+	case WriteThrough, WriteBehind, WriteNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown write policy %q", s)
+}
+
+// RemoteMode restricts what proc does with the remote tiers, whatever their
+// write policies.
+type RemoteMode string
+
+const (
+	RemoteReadWrite RemoteMode = "rw"
+
+	// RemoteReadOnly never writes to the remote tiers, for builds that
+	// aren't trusted with the shared cache.
+	RemoteReadOnly RemoteMode = "ro"
+
+	// RemoteWriteOnly never reads from the remote tiers, for jobs that only
+	// warm them up.
+	RemoteWriteOnly RemoteMode = "wo"
+)
+
+func ParseRemoteMode(s string) (RemoteMode, error) {
+	switch m := RemoteMode(s); m {
+	case RemoteReadWrite, RemoteReadOnly, RemoteWriteOnly:
+		return m, nil
+	case "":
+		return RemoteReadWrite, nil
+	}
+	return "", fmt.Errorf("unknown remote mode %q", s)
+}
+
+func (m RemoteMode) reads() bool  { return m != RemoteWriteOnly }
+func (m RemoteMode) writes() bool { return m != RemoteReadOnly }
+
+// Tier is one cache of the chain proc consults, fastest first. The first
+// tier is where cmd/go reads outputs from, so it has to be on the local disk
+// and written through.
+type Tier struct {
+	// Name identifies the cache in logs and stats, and keeps the state
+	// that is only valid for one cache, such as its negative cache, apart.
+	Name  string
+	Cache cachers.Cache
+	Write WritePolicy
+}
+
+// tier is a Tier below the local one, with its own breaker, negative cache,
+// pack index and, for write-behind tiers, upload queue.
+type tier struct {
+	Tier
+	breaker  *breaker
+	negcache *negativeCache
+	uploads  *uploader
+	packs    *packIndex // for tiers that keep packs
+}
+
+// probeActionID is asked for when probing a tier; any answer, a miss
+// included, shows it is back.
+var probeActionID = strings.Repeat("0", 64)
+
+func (t *tier) probe(ctx context.Context) error {
+	_, err := t.Cache.GetAction(ctx, probeActionID)
+	if errors.Is(err, cachers.ErrNotFound) || errors.Is(err, cachers.ErrCorrupt) {
+		return nil
+	}
+	return err
+}
+
+// writeTiers writes the local entry a to tiers, each as its write policy
+// says. Outputs smaller than the minimum upload size stay local, as does
+// everything in read-only mode.
+func (p *Process) writeTiers(ctx context.Context, tiers []*tier, a *cachers.Action) {
+	for _, t := range tiers {
+		t.negcache.forget(a.ActionID)
+	}
+	if a.Size < p.minUploadSize || !p.mode.writes() {
+		return
+	}
+
+	for _, t := range tiers {
+		switch t.Write {
+		case WriteThrough:
+			err := p.writeThrough(ctx, t, a)
+			switch {
+			case errors.Is(err, errRemoteUnavailable):
+				p.stats.RemoteSkipped.Inc()
+			case errors.Is(err, errOutputMismatch):
+				p.quarantine(a.ActionID, a.DiskPath)
+				return
+			case err != nil:
+				p.stats.UploadsFailed.Inc()
+				log.Printf("%s: put(action %s, obj %s, %v bytes): %v", t.Name, a.ActionID, a.OutputID, a.Size, err)
+			default:
+				p.stats.Uploads.Inc()
+				p.stats.BytesUploaded.Add(a.Size)
+			}
+		case WriteBehind:
+			// Upload from the local file rather than keeping a copy of
+			// the body in memory until the upload is done.
+			t.uploads.enqueue(ctx, a.ActionID, a.OutputID, a.Size, a.DiskPath)
+		}
+	}
+}
+
+// writeThrough puts the local entry a to t and waits for it.
+func (p *Process) writeThrough(ctx context.Context, t *tier, a *cachers.Action) error {
+	if !t.breaker.allow() {
+		return errRemoteUnavailable
+	}
+
+	ctx, span := tracing.Tracer().Start(ctx, "write_through")
+	span.SetAttributes(attrTier.String(t.Name))
+	defer span.End()
+
+	f, err := os.Open(a.DiskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := verifyFile(f, a.OutputID, a.Size); err != nil {
+		return err
+	}
+
+	tctx := ctx
+	if p.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(ctx, p.uploadTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	_, err = t.Cache.Put(tctx, a.ActionID, a.OutputID, a.Size, f)
+	t.breaker.done(ctx, err, 0)
+	if err != nil {
+		return err
+	}
+	p.stats.RemotePut.Since(start)
+	return nil
+}
+
+// findTier returns the remote tier called name.
+func (p *Process) findTier(name string) *tier {
+	for _, t := range p.tiers {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
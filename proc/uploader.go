@@ -0,0 +1,401 @@
+package proc
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
+	"github.com/adambenhassen/gocacheprog/stats"
+	"github.com/adambenhassen/gocacheprog/tracing"
+)
+
+// QueueFullPolicy decides what happens to an upload when the queue is full.
+type QueueFullPolicy string
+
+const (
+	// QueueFullBlock makes the put wait for room, slowing cmd/go down to
+	// the pace of the remote.
+	QueueFullBlock QueueFullPolicy = "block"
+
+	// QueueFullDrop skips the upload and counts it as dropped.
+	QueueFullDrop QueueFullPolicy = "drop"
+)
+
+func ParseQueueFullPolicy(s string) (QueueFullPolicy, error) {
+	switch p := QueueFullPolicy(s); p {
+	case QueueFullBlock, QueueFullDrop:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown queue full policy %q", s)
+}
+
+// UploadOptions configures the background upload queue.
+type UploadOptions struct {
+	Workers    int
+	MaxBytes   int64
+	MaxEntries int
+	WhenFull   QueueFullPolicy
+
+	// Timeout bounds each upload. Zero waits for the remote indefinitely.
+	Timeout time.Duration
+}
+
+type uploadKey struct {
+	actionID string
+	outputID string
+}
+
+// uploadJob uploads one output, read back from the local disk cache, for
+// every action that produced it.
+type uploadJob struct {
+	outputID  string
+	actionIDs []string
+	size      int64
+	path      string
+	queued    time.Time
+	index     int
+
+	// span is the put that queued the job, the parent of its upload spans.
+	span trace.SpanContext
+}
+
+// uploadHeap orders jobs smallest first: small outputs are the cheapest way
+// to get the most entries onto the remote before the process exits.
+type uploadHeap []*uploadJob
+
+func (h uploadHeap) Len() int { return len(h) }
+func (h uploadHeap) Less(i, j int) bool {
+	if h[i].size != h[j].size {
+		return h[i].size < h[j].size
+	}
+	return h[i].queued.Before(h[j].queued)
+}
+func (h uploadHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *uploadHeap) Push(x any) {
+	job := x.(*uploadJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+func (h *uploadHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return job
+}
+
+// uploader is a bounded pool of workers uploading outputs to a write-behind
+// tier.
+// Jobs are coalesced by outputID: a queued or in-flight output picks up any
+// further actions that produced it instead of being queued again.
+type uploader struct {
+	name    string // of the tier, in the journal and logs
+	remote  cachers.Cache
+	journal *journal
+	breaker *breaker
+	stats   *stats.Stats
+	opts    UploadOptions
+
+	// quarantine takes a local entry found corrupt out of use.
+	quarantine func(actionID, path string)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    uploadHeap
+	byOutput map[string]*uploadJob
+	seen     map[uploadKey]struct{}
+	bytes    int64
+	inflight int
+	closed   bool
+
+	// When uploads first started and last finished, and how many bytes
+	// they uploaded, for the throughput.
+	firstStart time.Time
+	lastDone   time.Time
+	uploaded   int64
+}
+
+func newUploader(name string, remote cachers.Cache, journal *journal, b *breaker, st *stats.Stats, opts UploadOptions, quarantine func(actionID, path string)) *uploader {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	u := &uploader{
+		name:       name,
+		remote:     remote,
+		journal:    journal,
+		breaker:    b,
+		stats:      st,
+		opts:       opts,
+		quarantine: quarantine,
+		byOutput:   map[string]*uploadJob{},
+		seen:       map[uploadKey]struct{}{},
+	}
+	u.cond = sync.NewCond(&u.mu)
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+
+	for range opts.Workers {
+		u.wg.Add(1)
+		go u.work()
+	}
+	return u
+}
+
+// enqueue schedules the output at path to be uploaded for actionID. It
+// blocks or drops when the queue is full, depending on the policy. Either
+// way the upload is journaled first, so a dropped one is retried next run.
+func (u *uploader) enqueue(ctx context.Context, actionID, outputID string, size int64, path string) {
+	u.journal.add(u.name, actionID, outputID, size, path)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := uploadKey{actionID, outputID}
+	if _, ok := u.seen[key]; ok {
+		u.stats.UploadsDeduped.Inc()
+		return
+	}
+
+	if job, ok := u.byOutput[outputID]; ok {
+		u.seen[key] = struct{}{}
+		job.actionIDs = append(job.actionIDs, actionID)
+		u.stats.UploadsCoalesced.Inc()
+		return
+	}
+
+	for !u.closed && u.full(size) {
+		if u.opts.WhenFull != QueueFullBlock {
+			u.stats.UploadsDropped.Inc()
+			return
+		}
+		u.cond.Wait()
+	}
+	if u.closed {
+		u.stats.UploadsDropped.Inc()
+		return
+	}
+
+	job := &uploadJob{
+		outputID:  outputID,
+		actionIDs: []string{actionID},
+		size:      size,
+		path:      path,
+		queued:    time.Now(),
+		span:      trace.SpanContextFromContext(ctx),
+	}
+	u.seen[key] = struct{}{}
+	u.byOutput[outputID] = job
+	heap.Push(&u.queue, job)
+	u.bytes += size
+	u.stats.UploadQueueMaxDepth.Observe(int64(len(u.queue)))
+	u.stats.UploadQueueMaxBytes.Observe(u.bytes)
+	u.cond.Broadcast()
+}
+
+// full reports whether a job of size doesn't fit in the queue. An empty
+// queue always takes a job, however big, so oversized outputs still go out.
+func (u *uploader) full(size int64) bool {
+	if len(u.queue) == 0 {
+		return false
+	}
+	if u.opts.MaxEntries > 0 && len(u.queue) >= u.opts.MaxEntries {
+		return true
+	}
+	return u.opts.MaxBytes > 0 && u.bytes+size > u.opts.MaxBytes
+}
+
+func (u *uploader) next() *uploadJob {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for len(u.queue) == 0 && !u.closed {
+		u.cond.Wait()
+	}
+	if len(u.queue) == 0 {
+		return nil
+	}
+
+	job := heap.Pop(&u.queue).(*uploadJob)
+	u.bytes -= job.size
+	u.inflight++
+	if u.firstStart.IsZero() {
+		u.firstStart = time.Now()
+	}
+	u.cond.Broadcast()
+	return job
+}
+
+func (u *uploader) work() {
+	defer u.wg.Done()
+
+	for {
+		job := u.next()
+		if job == nil {
+			return
+		}
+
+		for i := 0; ; i++ {
+			// Actions keep joining the job while it is in flight.
+			u.mu.Lock()
+			if i == len(job.actionIDs) {
+				delete(u.byOutput, job.outputID)
+				u.inflight--
+				u.lastDone = time.Now()
+				u.mu.Unlock()
+				break
+			}
+			actionID := job.actionIDs[i]
+			u.mu.Unlock()
+
+			err := u.upload(job, actionID)
+
+			switch {
+			case u.ctx.Err() != nil:
+				u.stats.UploadsAbandoned.Inc()
+			case errors.Is(err, errRemoteUnavailable):
+				// Left in the journal for a later run or flush.
+				u.stats.RemoteSkipped.Inc()
+			case errors.Is(err, errOutputMismatch):
+				u.quarantine(actionID, job.path)
+				u.journal.done(u.name, actionID, job.outputID)
+			case err != nil:
+				u.stats.UploadsFailed.Inc()
+				log.Printf("%s: put(action %s, obj %s, %v bytes): %v", u.name, actionID, job.outputID, job.size, err)
+			default:
+				u.stats.Uploads.Inc()
+				u.stats.BytesUploaded.Add(job.size)
+				u.mu.Lock()
+				u.uploaded += job.size
+				u.mu.Unlock()
+				u.journal.done(u.name, actionID, job.outputID)
+				continue
+			}
+
+			// Let a later put of the same output try again.
+			u.mu.Lock()
+			delete(u.seen, uploadKey{actionID, job.outputID})
+			u.mu.Unlock()
+		}
+	}
+}
+
+func (u *uploader) upload(job *uploadJob, actionID string) (err error) {
+	if u.ctx.Err() != nil {
+		return u.ctx.Err()
+	}
+	if !u.breaker.allow() {
+		return errRemoteUnavailable
+	}
+
+	start := time.Now()
+	u.stats.UploadQueueWait.Observe(start.Sub(job.queued))
+
+	ctx, span := tracing.Tracer().Start(trace.ContextWithSpanContext(u.ctx, job.span), "upload", trace.WithAttributes(
+		attrTier.String(u.name),
+		attrActionID.String(actionID),
+		attrOutputID.String(job.outputID),
+		attrSize.Int64(job.size),
+		attribute.Int64("gocacheprog.queue_wait_ms", start.Sub(job.queued).Milliseconds()),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	f, err := os.Open(job.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := verifyFile(f, job.outputID, job.size); err != nil {
+		return err
+	}
+
+	if u.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.opts.Timeout)
+		defer cancel()
+	}
+
+	// Large outputs take long to upload on a healthy remote too, so only
+	// failures count against it.
+	_, err = u.remote.Put(ctx, actionID, job.outputID, job.size, f)
+	u.breaker.done(u.ctx, err, 0)
+	if err != nil {
+		return err
+	}
+	u.stats.RemotePut.Since(start)
+	return nil
+}
+
+// pending returns the number of uploads queued or in flight.
+func (u *uploader) pending() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	n := u.inflight
+	for _, job := range u.queue {
+		n += len(job.actionIDs)
+	}
+	return n
+}
+
+// close stops accepting uploads and waits for the queue to drain for up to
+// timeout. Whatever is still queued or running afterwards is cancelled and
+// counted as abandoned. Zero waits indefinitely.
+func (u *uploader) close(timeout time.Duration) (abandoned int64) {
+	u.mu.Lock()
+	u.closed = true
+	u.cond.Broadcast()
+	u.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	select {
+	case <-done:
+	case <-deadline:
+		u.cancel()
+		<-done
+	}
+
+	return u.stats.UploadsAbandoned.Load()
+}
+
+// window returns when uploads first started and last finished, and how many
+// bytes they uploaded.
+func (u *uploader) window() (start, end time.Time, uploaded int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.firstStart, u.lastDone, u.uploaded
+}
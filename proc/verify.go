@@ -0,0 +1,92 @@
+package proc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/adambenhassen/gocacheprog/cachers"
+)
+
+// Output IDs are the SHA-256 of the output, so outputs are checked against
+// them on their way in and out of the local cache.
+var errOutputMismatch = fmt.Errorf("%w: output doesn't match its ID", cachers.ErrCorrupt)
+
+// verifier hashes what is read through it, and fails the read that reaches
+// EOF if it isn't size bytes hashing to outputID, so that the local cache
+// discards the output rather than keeping it.
+type verifier struct {
+	r        io.Reader
+	h        hash.Hash
+	n        int64
+	outputID string
+	size     int64
+}
+
+func newVerifier(r io.Reader, outputID string, size int64) *verifier {
+	return &verifier{r: r, h: sha256.New(), outputID: outputID, size: size}
+}
+
+func (v *verifier) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+	v.n += int64(n)
+	if v.n > v.size {
+		return n, fmt.Errorf("%w: more than %d bytes", errOutputMismatch, v.size)
+	}
+	if err == io.EOF {
+		if verr := v.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// verify checks what was read so far.
+func (v *verifier) verify() error {
+	if v.n != v.size {
+		return fmt.Errorf("%w: got %d bytes of %d", errOutputMismatch, v.n, v.size)
+	}
+	if got := hex.EncodeToString(v.h.Sum(nil)); got != v.outputID {
+		return fmt.Errorf("%w: got %s", errOutputMismatch, got)
+	}
+	return nil
+}
+
+// verifyFile checks that f holds the output outputID of size bytes, and
+// rewinds it.
+func verifyFile(f *os.File, outputID string, size int64) error {
+	v := newVerifier(f, outputID, size)
+	if _, err := io.Copy(io.Discard, v); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// quarantine takes a local entry whose output doesn't match its ID out of
+// use: the action is deleted, and the output moved under <dir>/quarantine for
+// inspection.
+func (p *Process) quarantine(actionID, path string) {
+	p.stats.LocalCorrupt.Inc()
+	log.Printf("quarantining corrupt local entry %s: %s", actionID, path)
+
+	if err := p.local.Delete(context.Background(), actionID); err != nil {
+		log.Printf("quarantine %s: %v", actionID, err)
+	}
+
+	dir := filepath.Join(p.dir, "quarantine")
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("quarantine %s: %v", actionID, err)
+	}
+}
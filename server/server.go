@@ -13,16 +13,42 @@ GET /action/<actionID-hex>
 GET /output/<outputID-hex>
 200 of those bytes with Content-Length or 404
 
+HEAD /output/<outputID-hex>
+200 with Content-Length or 404
+
+DELETE /action/<actionID-hex>
+204, whether or not the action was there
+
 PUT /<actionID>/<outputID>
 Content-Length: 1234
 <bytes>
 
+GET /manifest/<name>
+200 with the action IDs last used by a build, one hex ID per line, or 404
+
+PUT /manifest/<name>
+<action IDs>
+
+GET /pack/<scope>/
+200 with the names of the complete packs, one per line
+
+GET /pack/<scope>/<name>
+200 or 206 of the pack, honoring Range, or 404
+
+GET /pack/<scope>/<name>.idx
+200 with the index of the pack, or 404
+
+PUT /pack/<scope>/<name>
+PUT /pack/<scope>/<name>.idx
+<bytes>
+
 */
 package server
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -38,12 +64,13 @@ import (
 
 type server struct {
 	cache   cachers.Cache
+	disk    *disk.DiskCache
 	verbose bool
 	dir     string
 	secret  string
 }
 
-func Run(ctx context.Context, listen, secret, dir string, verbose bool) {
+func Run(ctx context.Context, listen, secret, dir string, opts disk.Options, verbose bool) {
 	flag.Parse()
 	if dir == "" {
 		d, err := os.UserCacheDir()
@@ -59,15 +86,29 @@ func Run(ctx context.Context, listen, secret, dir string, verbose bool) {
 
 	log.Println("cache dir:", dir)
 
+	cache, err := disk.NewCache(ctx, dir, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	srv := &server{
-		cache:   disk.NewCache(ctx, dir, verbose),
+		cache:   cache,
+		disk:    cache,
 		verbose: verbose,
 		dir:     dir,
 		secret:  secret,
 	}
 
+	hs := &http.Server{Addr: listen, Handler: srv}
+	go func() {
+		<-ctx.Done()
+		hs.Shutdown(context.Background())
+	}()
+
 	log.Println("listening..")
-	log.Fatal(http.ListenAndServe(listen, srv))
+	if err := hs.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -82,11 +123,29 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "PUT" {
+		if strings.HasPrefix(r.URL.Path, "/manifest/") {
+			s.handlePutManifest(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/pack/") {
+			s.handlePutPack(w, r)
+			return
+		}
 		s.handlePut(w, r)
 		return
 	}
 
-	if r.Method != "GET" {
+	if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/action/") {
+		s.handleDeleteAction(w, r)
+		return
+	}
+	if r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/pack/") {
+		s.handleDeletePack(w, r)
+		return
+	}
+
+	// HEAD is served by ServeFile like GET, without the body.
+	if r.Method != "GET" && !(r.Method == "HEAD" && strings.HasPrefix(r.URL.Path, "/output/")) {
 		http.Error(w, "bad method", http.StatusBadRequest)
 		return
 	}
@@ -98,6 +157,12 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case strings.HasPrefix(r.URL.Path, "/output/"):
 		s.handleGetOutput(w, r)
 
+	case strings.HasPrefix(r.URL.Path, "/manifest/"):
+		s.handleGetManifest(w, r)
+
+	case strings.HasPrefix(r.URL.Path, "/pack/"):
+		s.handleGetPack(w, r)
+
 	case r.URL.Path == "/":
 		_, _ = io.WriteString(w, "hi")
 
@@ -137,18 +202,17 @@ func (s *server) handleGetAction(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := r.Context()
-	outputID, diskPath, _, _, err := s.cache.Get(ctx, actionID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	a, err := s.cache.GetAction(ctx, actionID)
+	if errors.Is(err, cachers.ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-
-	if outputID == "" {
-		http.Error(w, "not found ()", http.StatusNotFound)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	fi, err := os.Stat(diskPath)
+	fi, err := os.Stat(a.DiskPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			http.Error(w, "not found (post-stat)", http.StatusNotFound)
@@ -161,7 +225,7 @@ func (s *server) handleGetAction(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(&cachers.ActionValue{
-		OutputID: outputID,
+		OutputID: a.OutputID,
 		Size:     fi.Size(),
 	})
 }
@@ -174,7 +238,22 @@ func (s *server) handleGetOutput(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	http.ServeFile(w, r, outputFilename(s.dir, outputID))
+	http.ServeFile(w, r, outputFilename(s.disk, outputID))
+}
+
+func (s *server) handleDeleteAction(w http.ResponseWriter, r *http.Request) {
+	actionID, ok := getHexSuffix(r, "/action/")
+	if !ok {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.cache.Delete(r.Context(), actionID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
@@ -204,7 +283,161 @@ func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func outputFilename(dir, objectID string) string {
+// maxManifestSize bounds a manifest upload; a few million action IDs.
+const maxManifestSize = 256 << 20
+
+func (s *server) handleGetManifest(w http.ResponseWriter, r *http.Request) {
+	file, ok := manifestFilename(s.dir, strings.TrimPrefix(r.URL.Path, "/manifest/"))
+	if !ok {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeFile(w, r, file)
+}
+
+func (s *server) handlePutManifest(w http.ResponseWriter, r *http.Request) {
+	file, ok := manifestFilename(s.dir, strings.TrimPrefix(r.URL.Path, "/manifest/"))
+	if !ok {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	writeFile(w, r, file, maxManifestSize)
+}
+
+// maxPackSize bounds a pack upload.
+const maxPackSize = 4 << 30
+
+func (s *server) handleGetPack(w http.ResponseWriter, r *http.Request) {
+	scope, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/pack/"), "/")
+	if name == "" {
+		s.handleListPacks(w, scope)
+		return
+	}
+
+	file, ok := packFilename(s.dir, scope, name)
+	if !ok {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, file)
+}
+
+// handleListPacks lists the packs whose index is in, which is put last.
+func (s *server) handleListPacks(w http.ResponseWriter, scope string) {
+	if !validName(scope) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	files, err := os.ReadDir(filepath.Join(s.dir, "packs", scope))
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	for _, fi := range files {
+		if name, ok := strings.CutSuffix(fi.Name(), ".idx"); ok {
+			fmt.Fprintln(w, name)
+		}
+	}
+}
+
+func (s *server) handlePutPack(w http.ResponseWriter, r *http.Request) {
+	scope, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/pack/"), "/")
+	file, ok := packFilename(s.dir, scope, name)
+	if !ok {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	writeFile(w, r, file, maxPackSize)
+}
+
+// handleDeletePack removes a pack or its index. Removing one that is gone
+// is not an error.
+func (s *server) handleDeletePack(w http.ResponseWriter, r *http.Request) {
+	scope, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/pack/"), "/")
+	file, ok := packFilename(s.dir, scope, name)
+	if !ok {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeFile replaces file atomically with the request body, up to limit
+// bytes.
+func writeFile(w http.ResponseWriter, r *http.Request, file string, limit int64) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tf.Name())
+
+	_, err = io.Copy(tf, http.MaxBytesReader(w, r.Body, limit))
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tf.Name(), file)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func manifestFilename(dir, name string) (string, bool) {
+	if !validName(name) {
+		return "", false
+	}
+	return filepath.Join(dir, "manifests", name), true
+}
+
+func packFilename(dir, scope, name string) (string, bool) {
+	if !validName(scope) || !validName(name) {
+		return "", false
+	}
+	return filepath.Join(dir, "packs", scope, name), true
+}
+
+// validName reports whether name is safe as a file name.
+func validName(name string) bool {
+	if name == "" || len(name) > 200 || name[0] == '.' {
+		return false
+	}
+
+	for i := range name {
+		b := name[i]
+		if b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '-' || b == '_' || b == '.' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func outputFilename(dc *disk.DiskCache, objectID string) string {
 	if len(objectID) < 4 || len(objectID) > 1000 {
 		return ""
 	}
@@ -217,5 +450,5 @@ func outputFilename(dir, objectID string) string {
 		return ""
 	}
 
-	return filepath.Join(dir, fmt.Sprintf("o-%s", objectID))
+	return dc.OutputFile(objectID)
 }
@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucketBounds are the upper bounds of the histogram buckets, doubling from
+// 100µs to a bit under two minutes. Anything slower lands in a final
+// overflow bucket.
+var bucketBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 21)
+	for i := range bounds {
+		bounds[i] = 100 * time.Microsecond << i
+	}
+	return bounds
+}()
+
+// Histogram records latencies into exponential buckets.
+type Histogram struct {
+	mu     sync.Mutex
+	counts [22]int64
+	count  int64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(bucketBounds) && d > bucketBounds[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if h.count == 1 || d < h.min {
+		h.min = d
+	}
+	h.max = max(h.max, d)
+}
+
+// Since observes the time elapsed since start.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// quantile estimates the q-th quantile as the upper bound of the bucket it
+// falls in, clamped to the largest value seen.
+func (h *Histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(q * float64(h.count)))
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank && i < len(bucketBounds) {
+			return min(bucketBounds[i], h.max)
+		}
+	}
+	return h.max
+}
+
+type bucketJSON struct {
+	LeMs  float64 `json:"le_ms,omitempty"` // omitted for the overflow bucket
+	Count int64   `json:"count"`
+}
+
+type histogramJSON struct {
+	Count   int64        `json:"count"`
+	SumMs   float64      `json:"sum_ms"`
+	MinMs   float64      `json:"min_ms"`
+	MaxMs   float64      `json:"max_ms"`
+	P50Ms   float64      `json:"p50_ms"`
+	P90Ms   float64      `json:"p90_ms"`
+	P99Ms   float64      `json:"p99_ms"`
+	Buckets []bucketJSON `json:"buckets,omitempty"`
+}
+
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hj := histogramJSON{
+		Count: h.count,
+		SumMs: ms(h.sum),
+		MinMs: ms(h.min),
+		MaxMs: ms(h.max),
+		P50Ms: ms(h.quantile(0.50)),
+		P90Ms: ms(h.quantile(0.90)),
+		P99Ms: ms(h.quantile(0.99)),
+	}
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		b := bucketJSON{Count: n}
+		if i < len(bucketBounds) {
+			b.LeMs = ms(bucketBounds[i])
+		}
+		hj.Buckets = append(hj.Buckets, b)
+	}
+	return json.Marshal(hj)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
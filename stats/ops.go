@@ -0,0 +1,35 @@
+package stats
+
+// Op records the calls of one cache operation.
+type Op struct {
+	Calls    Counter   `json:"calls"`
+	NotFound Counter   `json:"not_found"`
+	Errors   Counter   `json:"errors"` // other than not found
+	Latency  Histogram `json:"latency"`
+}
+
+// Ops records the calls made to a cache, by operation.
+type Ops struct {
+	GetAction Op `json:"get_action"`
+	GetOutput Op `json:"get_output"`
+	Put       Op `json:"put"`
+	Stat      Op `json:"stat"`
+	Delete    Op `json:"delete"`
+}
+
+// Op returns the record of the operation called name, or nil.
+func (o *Ops) Op(name string) *Op {
+	switch name {
+	case "get_action":
+		return &o.GetAction
+	case "get_output":
+		return &o.GetOutput
+	case "put":
+		return &o.Put
+	case "stat":
+		return &o.Stat
+	case "delete":
+		return &o.Delete
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Package stats collects what a gocacheprog run did, for the end-of-run log
+// line and for a machine-readable JSON report.
+package stats
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Add(n int64) { c.v.Add(n) }
+func (c *Counter) Inc()        { c.v.Add(1) }
+func (c *Counter) Load() int64 { return c.v.Load() }
+
+func (c *Counter) MarshalJSON() ([]byte, error) {
+	return strconv.AppendInt(nil, c.Load(), 10), nil
+}
+
+// Max keeps the largest value it has observed.
+type Max struct {
+	v atomic.Int64
+}
+
+func (m *Max) Observe(n int64) {
+	for {
+		old := m.v.Load()
+		if n <= old || m.v.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+func (m *Max) Load() int64 { return m.v.Load() }
+
+func (m *Max) MarshalJSON() ([]byte, error) {
+	return strconv.AppendInt(nil, m.Load(), 10), nil
+}
+
+// Labels counts by label.
+type Labels struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func (l *Labels) Inc(label string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = map[string]int64{}
+	}
+	l.m[label]++
+}
+
+// Snapshot returns a copy of the counts.
+func (l *Labels) Snapshot() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m := make(map[string]int64, len(l.m))
+	for k, v := range l.m {
+		m[k] = v
+	}
+	return m
+}
+
+func (l *Labels) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Snapshot())
+}
+
+// Event is a change of state during the run.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source,omitempty"`
+	State  string    `json:"state"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Events is the log of the changes of state of something.
+type Events struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (e *Events) Add(source, state, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, Event{Time: time.Now(), Source: source, State: state, Reason: reason})
+}
+
+func (e *Events) MarshalJSON() ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.events == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(e.events)
+}
+
+// Stats is the report of a run. The zero value is ready to use; fields are
+// safe for concurrent updates.
+type Stats struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	Gets           Counter `json:"gets"`
+	HitsLocal      Counter `json:"hits_local"`
+	HitsRemote     Counter `json:"hits_remote"`
+	HitsByTier     Labels  `json:"hits_by_tier"` // remote hits, by the tier that had the entry
+	HitsByKey      Labels  `json:"hits_by_key"`  // remote hits, by the cache key that had the entry, for remotes that have keys
+	HitsPacked     Counter `json:"hits_packed"`  // remote hits read from a pack
+	Misses         Counter `json:"misses"`
+	MissesCached   Counter `json:"misses_cached"`  // answered by the negative cache
+	GetsCoalesced  Counter `json:"gets_coalesced"` // joined a remote get of the same action in flight
+	Puts           Counter `json:"puts"`
+	PutsIgnored    Counter `json:"puts_ignored"`
+	PutsPacked     Counter `json:"puts_packed"`     // too small to upload on their own, packed instead
+	PutsSuppressed Counter `json:"puts_suppressed"` // not written to the remote tiers, which are read-only
+	BadRequests    Counter `json:"bad_requests"`    // answered with an error without being served
+	RemoteCorrupt  Counter `json:"remote_corrupt"`  // downloads that didn't match their output ID, counted as misses
+	LocalCorrupt   Counter `json:"local_corrupt"`   // local entries that didn't match their output ID, quarantined
+
+	Prefetched     Counter `json:"prefetched"`
+	PrefetchFailed Counter `json:"prefetch_failed"`
+	HitsPrefetched Counter `json:"hits_prefetched"` // local hits that were prefetched
+
+	BytesDownloaded Counter `json:"bytes_downloaded"`
+	BytesUploaded   Counter `json:"bytes_uploaded"`
+
+	Uploads          Counter `json:"uploads"`
+	UploadsFailed    Counter `json:"uploads_failed"`
+	UploadsDropped   Counter `json:"uploads_dropped"`
+	UploadsDeduped   Counter `json:"uploads_deduped"`   // the same action and output again
+	UploadsCoalesced Counter `json:"uploads_coalesced"` // joined an upload of the same output
+	UploadsAbandoned Counter `json:"uploads_abandoned"`
+	PacksUploaded    Counter `json:"packs_uploaded"`
+
+	RemoteTimeouts Counter `json:"remote_timeouts"`
+	RemoteSkipped  Counter `json:"remote_skipped"` // gets and uploads skipped while the breaker was open
+	BreakerOpened  Counter `json:"breaker_opened"`
+	Breaker        Events  `json:"breaker_events"`
+
+	UploadQueueMaxDepth Max   `json:"upload_queue_max_depth"`
+	UploadQueueMaxBytes Max   `json:"upload_queue_max_bytes"`
+	UploadThroughput    int64 `json:"upload_throughput_bytes_per_sec"`
+
+	LocalGet        Histogram `json:"local_get"`
+	RemoteGet       Histogram `json:"remote_get"`
+	RemotePut       Histogram `json:"remote_put"`
+	UploadQueueWait Histogram `json:"upload_queue_wait"`
+
+	// Calls to the caches, recorded by the metrics middleware.
+	LocalOps  Ops `json:"local_ops"`
+	RemoteOps Ops `json:"remote_ops"`
+}
+
+func New() *Stats {
+	return &Stats{Start: time.Now()}
+}
+
+// WriteFile writes s as JSON to path, replacing it atomically.
+func (s *Stats) WriteFile(path string) error {
+	if s.End.IsZero() {
+		s.End = time.Now()
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := tf.Write(append(b, '\n')); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), path)
+}
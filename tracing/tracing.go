@@ -0,0 +1,70 @@
+// Package tracing sets up OpenTelemetry tracing for gocacheprog.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const name = "github.com/adambenhassen/gocacheprog"
+
+// Tracer returns the tracer gocacheprog creates its spans with. Until Setup
+// installs a provider it is a no-op.
+func Tracer() trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Setup installs the global tracer provider. dest is "otlp" to export over
+// OTLP/HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables, or
+// the path of a file that receives the spans as JSON. The returned function
+// flushes the spans and must be called before exiting.
+func Setup(ctx context.Context, dest string) (shutdown func(context.Context) error, err error) {
+	var exp sdktrace.SpanExporter
+	var file *os.File
+
+	switch dest {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		file, err = os.Create(dest)
+		if err != nil {
+			return nil, err
+		}
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("gocacheprog")))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
@@ -1,6 +1,11 @@
 package utils
 
-import "time"
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
 
 func FormatDuration(d time.Duration) string {
 	// Start with a scale 100 times greater than a second.
@@ -16,3 +21,32 @@ func FormatDuration(d time.Duration) string {
 	// then convert it to a string and return.
 	return d.Round(scale / 100).String()
 }
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// TargetPlatform returns the GOOS and GOARCH the go command is building for,
+// which is what the cache entries it asks for are specific to.
+func TargetPlatform() (goos, goarch string) {
+	goos = os.Getenv("GOOS")
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+
+	goarch = os.Getenv("GOARCH")
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	return goos, goarch
+}
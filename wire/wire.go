@@ -7,7 +7,10 @@
 // the cache interface.
 package wire
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // Cmd is a command that can be issued to a child process.
 //
@@ -16,8 +19,12 @@ import "io"
 type Cmd string
 
 const (
-	CmdGet   = Cmd("get")
-	CmdPut   = Cmd("put")
+	CmdGet = Cmd("get")
+	CmdPut = Cmd("put")
+
+	// CmdClose asks the child to exit gracefully. Since Go 1.24 the child
+	// is expected to reply, flush anything pending and exit, closing its
+	// stdout.
 	CmdClose = Cmd("close")
 )
 
@@ -38,7 +45,13 @@ type Request struct {
 	// ActionID is non-nil for get and puts.
 	ActionID []byte `json:",omitempty"` // or nil if not used
 
-	// ObjectID is set for Type "put" and "output-file".
+	// OutputID is set for Type "put".
+	OutputID []byte `json:",omitempty"` // or nil if not used
+
+	// ObjectID is the name OutputID had in the experimental protocol.
+	// Go 1.24 still populates both; later releases only send OutputID.
+	//
+	// Deprecated: use Output, which understands both spellings.
 	ObjectID []byte `json:",omitempty"` // or nil if not used
 
 	// Body is the body for "put" requests. It's sent after the JSON object
@@ -53,6 +66,14 @@ type Request struct {
 	BodySize int64 `json:",omitempty"`
 }
 
+// Output returns the output ID of a put, whichever protocol version sent it.
+func (r *Request) Output() []byte {
+	if len(r.OutputID) > 0 {
+		return r.OutputID
+	}
+	return r.ObjectID
+}
+
 // Response is the JSON response from the child process to cmd/go.
 //
 // With the exception of the first protocol message that the child writes to its
@@ -76,13 +97,15 @@ type Response struct {
 
 	// For Get requests.
 
-	Miss      bool   `json:",omitempty"` // cache miss
-	OutputID  []byte `json:",omitempty"`
-	Size      int64  `json:",omitempty"`
-	TimeNanos int64  `json:",omitempty"` // TODO(bradfitz): document
+	Miss     bool   `json:",omitempty"` // cache miss
+	OutputID []byte `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+
+	// Time is when the hit was put in the cache.
+	Time *time.Time `json:",omitempty"`
 
-	// DiskPath is the absolute path on disk of the ObjectID corresponding
+	// DiskPath is the absolute path on disk of the OutputID corresponding
 	// a "get" request's ActionID (on cache hit) or a "put" request's
-	// provided ObjectID.
+	// provided OutputID.
 	DiskPath string `json:",omitempty"`
 }